@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// AddAccount logs in to spotify and stores the credentials under the ID of
+// whoever logged in, replacing any they had before.
+func AddAccount(tokensPath string, auth *AuthOptions, retry *RetryPolicy) (string, error) {
+	token, err := authorize(auth)
+	if err != nil {
+		return "", err
+	}
+
+	_, user, err := saveAccount(tokensPath, token, retry)
+	if err != nil {
+		return "", err
+	}
+
+	return user.ID, nil
+}
+
+func RemoveAccount(tokensPath, user string) error {
+	return UpdateTokens(tokensPath, func(tokens *Tokens) error {
+		if _, ok := tokens.Accounts[user]; !ok {
+			return fmt.Errorf("no spotify account for %s", user)
+		}
+		delete(tokens.Accounts, user)
+		return nil
+	})
+}
+
+func WriteAccounts(w io.Writer, tokens *Tokens) {
+	fmt.Fprintf(w, "%-24s %s\n", "user", "expires")
+	for _, user := range tokens.Users() {
+		expires := "never"
+		if token, err := tokens.Accounts[user].Token(); err != nil {
+			expires = err.Error()
+		} else if !token.Expiry.IsZero() {
+			expires = token.Expiry.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%-24s %s\n", user, expires)
+	}
+	if tokens.Spotify != nil {
+		fmt.Fprintf(w, "%-24s %s\n", "(unknown)", "used by the next run and saved under its user")
+	}
+}
+
+func accountsCommand(options *Options, args []string) error {
+	usage := fmt.Errorf("usage: accounts add|list|remove USER")
+	if len(args) == 0 {
+		return usage
+	}
+
+	path := options.State.Tokens()
+
+	switch args[0] {
+	case "add":
+		user, err := AddAccount(path, &options.Auth, &options.Retry)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("added spotify account %s", user)
+	case "list":
+		tokens, err := ReadTokens(path)
+		if err != nil {
+			return err
+		}
+
+		WriteAccounts(os.Stdout, tokens)
+	case "remove":
+		if len(args) != 2 {
+			return usage
+		}
+
+		err := RemoveAccount(path, args[1])
+		if err != nil {
+			return err
+		}
+
+		log.Printf("removed spotify account %s", args[1])
+	default:
+		return fmt.Errorf("unknown accounts command: %v", args[0])
+	}
+
+	return nil
+}
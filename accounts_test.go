@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+const testLegacyTokens = `{"AccessToken": "old", "RefreshToken": "legacy", "Expiry": "", "TokenType": "Bearer"}`
+
+func testTokensFile(t *testing.T, dir, json string) string {
+	path := filepath.Join(dir, "tokens.json")
+	if err := ioutil.WriteFile(path, []byte(json), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTokensAddLegacy(t *testing.T) {
+	tests := []struct {
+		name     string
+		original string
+		kept     bool
+	}{
+		{"logged in with the legacy tokens", "legacy", false},
+		{"logged in some other way", "other", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testTempDir(t)
+			defer os.RemoveAll(dir)
+
+			path := testTokensFile(t, dir, `{"Spotify": `+testLegacyTokens+`}`)
+
+			tokens, err := ReadTokens(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tokens.Spotify == nil || len(tokens.Accounts) != 0 {
+				t.Fatalf("expected only the legacy tokens, got %+v", tokens)
+			}
+
+			err = UpdateTokens(path, func(tokens *Tokens) error {
+				tokens.Add("tester", &oauth2.Token{AccessToken: "new", RefreshToken: "legacy"}, &oauth2.Token{RefreshToken: test.original})
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tokens, err = ReadTokens(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if account := tokens.Accounts["tester"]; account == nil || account.AccessToken != "new" {
+				t.Errorf("expected the account saved, got %+v", tokens.Accounts)
+			}
+			if kept := tokens.Spotify != nil; kept != test.kept {
+				t.Errorf("expected legacy tokens kept %v, got %v", test.kept, kept)
+			}
+		})
+	}
+}
+
+func TestUpdateTokens(t *testing.T) {
+	dir := testTempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tokens.json")
+
+	// Concurrent updates each keep the others' accounts.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(user string) {
+			defer wg.Done()
+			err := UpdateTokens(path, func(tokens *Tokens) error {
+				tokens.Accounts[user] = &SpotifyTokens{AccessToken: user}
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(fmt.Sprintf("user%d", i))
+	}
+	wg.Wait()
+
+	tokens, err := ReadTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens.Users()) != 10 {
+		t.Errorf("expected 10 accounts, got %v", tokens.Users())
+	}
+
+	before, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = UpdateTokens(path, func(tokens *Tokens) error {
+		tokens.Accounts = nil
+		return fmt.Errorf("failed")
+	})
+	if err == nil {
+		t.Fatalf("expected the update's error")
+	}
+
+	after, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Errorf("expected a failed update to leave the tokens alone")
+	}
+}
+
+func TestRemoveAccount(t *testing.T) {
+	dir := testTempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := testTokensFile(t, dir, `{"accounts": {"alice": `+testLegacyTokens+`, "bob": `+testLegacyTokens+`}}`)
+
+	if err := RemoveAccount(path, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RemoveAccount(path, "carol"); err == nil {
+		t.Errorf("expected an error removing an unknown account")
+	}
+
+	tokens, err := ReadTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if users := tokens.Users(); !reflect.DeepEqual(users, []string{"bob"}) {
+		t.Errorf("expected only bob left, got %v", users)
+	}
+}
+
+func TestWriteAccounts(t *testing.T) {
+	tokens := &Tokens{
+		Accounts: map[string]*SpotifyTokens{
+			"bob":   {AccessToken: "b"},
+			"alice": {AccessToken: "a", Expiry: "2019-06-01T10:00:00Z"},
+		},
+		Spotify: &SpotifyTokens{AccessToken: "old"},
+	}
+
+	w := &bytes.Buffer{}
+	WriteAccounts(w, tokens)
+
+	lines := strings.Split(strings.TrimSpace(w.String()), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[1], "alice") || !strings.HasPrefix(lines[2], "bob") || !strings.HasPrefix(lines[3], "(unknown)") {
+		t.Errorf("unexpected accounts:\n%s", w.String())
+	}
+	if !strings.HasSuffix(lines[2], "never") {
+		t.Errorf("expected bob's tokens never to expire, got %s", lines[2])
+	}
+}
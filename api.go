@@ -1,11 +1,12 @@
+//go:build ignore
+// +build ignore
+
 package main
 
 import (
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"path/filepath"
 	"strings"
 	"time"
 
@@ -17,42 +18,66 @@ import (
 )
 
 type options struct {
-	RootPath string
+	State StateDirectory
+	Cache string
 }
 
 type LoadedPlaylist struct {
-	Path     string
+	Key      string
 	Playlist *PlaylistSummary
 	Tracks   []spotify.PlaylistTrack
 }
 
 type Playlists struct {
-	RootPath  string
+	State     *StateDirectory
+	Cache     string
 	LoadedAt  time.Time
 	Summaries *PlaylistSummaries
 	Playlists []*LoadedPlaylist
 }
 
-func NewPlaylists(rootPath string) (pl *Playlists) {
+func NewPlaylists(state *StateDirectory, cache string) (pl *Playlists) {
 	return &Playlists{
-		RootPath:  rootPath,
+		State:     state,
+		Cache:     cache,
 		Playlists: nil,
 	}
 }
 
+// Load reads the generator's cache, whichever storage it's in, holding its
+// lock only while loading.
 func (pl *Playlists) Load() error {
-	summaries, err := LoadSummaries(filepath.Join(pl.RootPath, ".cache/playlists.json"))
+	summaries, err := LoadSummaries(pl.State.Summaries())
+	if err != nil {
+		return err
+	}
+
+	lock, err := LockStorage(pl.Cache)
+	if err != nil {
+		return err
+	}
+
+	defer lock.Unlock()
+
+	storage, err := OpenStorage(pl.Cache)
 	if err != nil {
 		return err
 	}
 
+	defer storage.Close()
+
+	playlists := make([]*LoadedPlaylist, 0)
+
 	for _, playlist := range summaries.Playlists {
-		path := filepath.Join(pl.RootPath, fmt.Sprintf(".cache/playlist-%s.json", playlist.ID))
+		key := fmt.Sprintf("playlist-%s", playlist.ID)
 
-		bytes, err := ioutil.ReadFile(path)
+		bytes, err := storage.Get(key)
 		if err != nil {
 			return err
 		}
+		if bytes == nil {
+			return fmt.Errorf("playlist %s isn't cached", playlist.ID)
+		}
 
 		allTracks := make([]spotify.PlaylistTrack, 0)
 		err = json.Unmarshal(bytes, &allTracks)
@@ -60,15 +85,17 @@ func (pl *Playlists) Load() error {
 			return err
 		}
 
-		log.Printf("path %v %d", path, len(allTracks))
+		log.Printf("key %v %d", key, len(allTracks))
 
-		pl.Playlists = append(pl.Playlists, &LoadedPlaylist{
-			Path:     path,
+		playlists = append(playlists, &LoadedPlaylist{
+			Key:      key,
 			Playlist: playlist,
 			Tracks:   allTracks,
 		})
 	}
 
+	pl.Playlists = playlists
+
 	return nil
 }
 
@@ -171,11 +198,16 @@ func (pl *Playlists) Search(query string) (matches *SearchMatches, err error) {
 func main() {
 	o := &options{}
 
-	flag.StringVar(&o.RootPath, "path", "", "path")
+	flag.StringVar(&o.State.Path, "path", DefaultStateDirectory(), "generator state directory, also set by $"+StateEnvironmentVariable)
+	flag.StringVar(&o.Cache, "cache", "", "generator cache storage, dir:PATH or bolt:PATH, defaults to dir:STATE/cache")
 
 	flag.Parse()
 
-	pl := NewPlaylists(o.RootPath)
+	if o.Cache == "" {
+		o.Cache = o.State.Cache()
+	}
+
+	pl := NewPlaylists(&o.State, o.Cache)
 
 	http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
 		log.Printf("[http] %v", req.URL)
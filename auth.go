@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+type AuthOptions struct {
+	Listen   string
+	Redirect string
+}
+
+// Authorization is a single attempt at the authorization code flow, with its
+// own state and PKCE verifier so a stale or forged callback can't complete it.
+type Authorization struct {
+	config   *oauth2.Config
+	ctx      context.Context
+	state    string
+	verifier string
+}
+
+func randomString(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating random string: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func NewAuthorization(ctx context.Context, config *oauth2.Config) (*Authorization, error) {
+	state, err := randomString(16)
+	if err != nil {
+		return nil, err
+	}
+
+	verifier, err := randomString(48)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Authorization{
+		config:   config,
+		ctx:      ctx,
+		state:    state,
+		verifier: verifier,
+	}, nil
+}
+
+func (a *Authorization) URL() string {
+	challenge := sha256.Sum256([]byte(a.verifier))
+	return a.config.AuthCodeURL(a.state,
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])))
+}
+
+// Complete exchanges the code in the query spotify redirected to, which came
+// either to our listener or from the address pasted by the user.
+func (a *Authorization) Complete(query url.Values) (*oauth2.Token, error) {
+	if e := query.Get("error"); e != "" {
+		return nil, fmt.Errorf("spotify refused authorization: %s", e)
+	}
+
+	if query.Get("state") != a.state {
+		return nil, fmt.Errorf("state mismatch, this isn't from the latest log in attempt")
+	}
+
+	code := query.Get("code")
+	if code == "" {
+		return nil, fmt.Errorf("no authorization code")
+	}
+
+	token, err := a.config.Exchange(a.ctx, code, oauth2.SetAuthURLParam("code_verifier", a.verifier))
+	if err != nil {
+		return nil, fmt.Errorf("error exchanging authorization code: %v", err)
+	}
+
+	return token, nil
+}
+
+func (a *Authorization) callback(tokens chan<- *oauth2.Token) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, err := a.Complete(r.URL.Query())
+		if err != nil {
+			log.Printf("authorization failed: %v", err)
+			authPage(w, http.StatusBadRequest, "Authorization failed", fmt.Sprintf("%v. Try again by visiting the log in page.", err))
+			return
+		}
+
+		authPage(w, http.StatusOK, "Authorized", "You're logged in to spotify and can close this window.")
+
+		select {
+		case tokens <- token:
+		default:
+		}
+	}
+}
+
+func authPage(w http.ResponseWriter, status int, title, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<!DOCTYPE html><html><head><title>%s</title></head><body><h1>%s</h1><p>%s</p></body></html>",
+		html.EscapeString(title), html.EscapeString(title), html.EscapeString(message))
+}
+
+// paste completes the authorization from addresses typed in by the user, for
+// when the browser is on another machine and can't reach our listener. Once
+// done is closed it gives up, ignoring anything a read already waiting on r
+// returns.
+func (a *Authorization) paste(r io.Reader, done <-chan struct{}) (*oauth2.Token, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		select {
+		case <-done:
+			return nil, fmt.Errorf("authorization already completed")
+		default:
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		pasted, err := url.Parse(line)
+		if err != nil {
+			log.Printf("unable to parse pasted address: %v", err)
+			continue
+		}
+
+		token, err := a.Complete(pasted.Query())
+		if err != nil {
+			log.Printf("authorization failed: %v", err)
+			continue
+		}
+
+		return token, nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading pasted address: %v", err)
+	}
+
+	return nil, fmt.Errorf("no authorization address pasted")
+}
+
+func (a *Authorization) serve(listener net.Listener, done <-chan struct{}) (*oauth2.Token, error) {
+	redirect, err := url.Parse(a.config.RedirectURL)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("error parsing redirect url: %v", err)
+	}
+
+	path := redirect.Path
+	if path == "" {
+		path = "/"
+	}
+
+	tokens := make(chan *oauth2.Token, 1)
+	failed := make(chan error, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, a.callback(tokens))
+	server := &http.Server{Handler: mux}
+	go func() {
+		failed <- server.Serve(listener)
+	}()
+
+	defer server.Close()
+
+	select {
+	case token := <-tokens:
+		return token, nil
+	case err := <-failed:
+		return nil, fmt.Errorf("listening on %s: %v", listener.Addr(), err)
+	case <-done:
+		return nil, fmt.Errorf("authorization already completed")
+	}
+}
+
+type authorizationResult struct {
+	token *oauth2.Token
+	err   error
+}
+
+// Wait takes whichever comes first of spotify's redirect to listen and the
+// address the browser ends up on pasted into stdin, so a headless machine
+// works without knowing beforehand. When listen is empty or can't be bound
+// only a pasted address will do.
+func (a *Authorization) Wait(listen string, stdin io.Reader) (*oauth2.Token, error) {
+	var listener net.Listener
+	if listen != "" {
+		l, err := net.Listen("tcp", listen)
+		if err != nil {
+			log.Printf("unable to listen for the redirect: %v", err)
+		} else {
+			listener = l
+		}
+	}
+
+	log.Println("please log in to Spotify by visiting the following page in your browser:", a.URL())
+
+	if listener == nil {
+		log.Printf("then paste the address your browser ends up on here")
+		return a.paste(stdin, nil)
+	}
+
+	log.Printf("if your browser can't reach %s, paste the address it ends up on here", a.config.RedirectURL)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	results := make(chan authorizationResult, 2)
+	go func() {
+		token, err := a.serve(listener, done)
+		results <- authorizationResult{token, err}
+	}()
+	go func() {
+		token, err := a.paste(stdin, done)
+		results <- authorizationResult{token, err}
+	}()
+
+	// Either failing, say with nothing to read on stdin, leaves the other.
+	first := <-results
+	if first.err == nil {
+		return first.token, nil
+	}
+
+	second := <-results
+	return second.token, second.err
+}
+
+func authorize(options *AuthOptions) (*oauth2.Token, error) {
+	a, err := NewAuthorization(spotifyContext(), spotifyConfig(options.Redirect))
+	if err != nil {
+		return nil, err
+	}
+
+	return a.Wait(options.Listen, os.Stdin)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// testLogIn does what the browser does, returning where spotify redirects to.
+func testLogIn(t *testing.T, a *Authorization) string {
+	noRedirects := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	res, err := noRedirects.Get(a.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	return res.Header.Get("Location")
+}
+
+func testAuthorization(t *testing.T, m *MockSpotifyServer, redirect string) *Authorization {
+	a, err := NewAuthorization(context.Background(), m.OAuthConfig(redirect))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAuthorizationPaste(t *testing.T) {
+	tests := []struct {
+		name  string
+		input func(location string) string
+		fails bool
+	}{
+		{"pasted", func(location string) string { return location + "\n" }, false},
+		{"skips junk", func(location string) string {
+			return "\n%zz\nhttp://localhost/?state=wrong&code=mock-code\n" + location + "\n"
+		}, false},
+		{"refused", func(location string) string { return "http://localhost/?error=access_denied\n" }, true},
+		{"nothing pasted", func(location string) string { return "" }, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := NewMockSpotifyServer(NewFakeMusicService(testFixture()))
+			defer m.Close()
+
+			a := testAuthorization(t, m, "http://localhost/spotify/callback")
+			location := testLogIn(t, a)
+
+			token, err := a.Wait("", strings.NewReader(test.input(location)))
+			if test.fails {
+				if err == nil {
+					t.Fatalf("expected authorization to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token.AccessToken == "" {
+				t.Errorf("expected an access token")
+			}
+		})
+	}
+}
+
+func TestAuthorizationListener(t *testing.T) {
+	m := NewMockSpotifyServer(NewFakeMusicService(testFixture()))
+	defer m.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := testAuthorization(t, m, fmt.Sprintf("http://%s/spotify/callback", listener.Addr()))
+	location := testLogIn(t, a)
+
+	tokens := make(chan *oauth2.Token, 1)
+	go func() {
+		token, err := a.serve(listener, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		tokens <- token
+	}()
+
+	res, err := http.Get(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expected 200, got %d", res.StatusCode)
+	}
+
+	if token := <-tokens; token == nil || token.AccessToken == "" {
+		t.Errorf("expected an access token")
+	}
+}
+
+func TestAuthorizationFallsBackToPaste(t *testing.T) {
+	m := NewMockSpotifyServer(NewFakeMusicService(testFixture()))
+	defer m.Close()
+
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	a := testAuthorization(t, m, fmt.Sprintf("http://%s/spotify/callback", busy.Addr()))
+	location := testLogIn(t, a)
+
+	token, err := a.Wait(busy.Addr().String(), strings.NewReader(location+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken == "" {
+		t.Errorf("expected an access token")
+	}
+}
+
+func TestAuthorizationWaitTakesEither(t *testing.T) {
+	tests := []struct {
+		name  string
+		paste bool
+	}{
+		{"redirected", false},
+		{"pasted while listening", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := NewMockSpotifyServer(NewFakeMusicService(testFixture()))
+			defer m.Close()
+
+			free, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			listen := free.Addr().String()
+			free.Close()
+
+			a := testAuthorization(t, m, fmt.Sprintf("http://%s/spotify/callback", listen))
+			location := testLogIn(t, a)
+
+			stdin, typing := io.Pipe()
+			defer typing.Close()
+
+			tokens := make(chan *oauth2.Token, 1)
+			go func() {
+				token, err := a.Wait(listen, stdin)
+				if err != nil {
+					t.Error(err)
+				}
+				tokens <- token
+			}()
+
+			if test.paste {
+				io.WriteString(typing, location+"\n")
+			} else {
+				for i := 0; ; i++ {
+					res, err := http.Get(location)
+					if err == nil {
+						res.Body.Close()
+						break
+					}
+					if i == 50 {
+						t.Fatal(err)
+					}
+					time.Sleep(20 * time.Millisecond)
+				}
+			}
+
+			select {
+			case token := <-tokens:
+				if token == nil || token.AccessToken == "" {
+					t.Errorf("expected an access token")
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("timed out waiting for authorization")
+			}
+		})
+	}
+}
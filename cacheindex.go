@@ -0,0 +1,535 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zmb3/spotify"
+)
+
+const CacheIndexKey = "cache-index"
+
+var cacheKinds = []string{"album-tracks", "artist-albums", "playlists", "playlist", "album", "track"}
+
+var DefaultCacheTTLs = map[string]time.Duration{
+	"album":         90 * 24 * time.Hour,
+	"album-tracks":  90 * 24 * time.Hour,
+	"artist-albums": 7 * 24 * time.Hour,
+	"track":         30 * 24 * time.Hour,
+}
+
+func cacheKind(key string) string {
+	for _, kind := range cacheKinds {
+		if strings.HasPrefix(key, kind+"-") {
+			return kind
+		}
+	}
+	return "other"
+}
+
+func knownCacheKind(kind string) bool {
+	for _, known := range cacheKinds {
+		if kind == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Offline there's nothing to refresh expired entries from, so they're served
+// anyway and nothing is evicted.
+type CachePolicy struct {
+	TTLs    map[string]time.Duration
+	MaxSize int64
+	Offline bool
+}
+
+// TTLs are given as kind=duration pairs, for example "track=720h,album=0",
+// a zero duration meaning entries of that kind never expire. Playlists are
+// refreshed by snapshot and have no TTL unless one is given.
+func ParseCachePolicy(ttls string, maxMegabytes int) (*CachePolicy, error) {
+	policy := &CachePolicy{
+		TTLs:    make(map[string]time.Duration),
+		MaxSize: int64(maxMegabytes) * 1024 * 1024,
+	}
+
+	for kind, ttl := range DefaultCacheTTLs {
+		policy.TTLs[kind] = ttl
+	}
+
+	for _, term := range strings.Split(ttls, ",") {
+		if strings.TrimSpace(term) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(term, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid cache ttl '%s'", term)
+		}
+
+		kind := strings.TrimSpace(parts[0])
+		if !knownCacheKind(kind) {
+			return nil, fmt.Errorf("unknown cache kind '%s'", kind)
+		}
+
+		ttl, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid cache ttl '%s': %v", term, err)
+		}
+
+		policy.TTLs[kind] = ttl
+	}
+
+	return policy, nil
+}
+
+type CacheEntry struct {
+	Written  time.Time `json:"written"`
+	Accessed time.Time `json:"accessed"`
+	Size     int       `json:"size"`
+}
+
+type CacheCounts struct {
+	Hits   int `json:"hits"`
+	Misses int `json:"misses"`
+}
+
+type CacheIndex struct {
+	Entries map[string]*CacheEntry  `json:"entries"`
+	Counts  map[string]*CacheCounts `json:"counts"`
+}
+
+// The index keeps write and access times and hit counts that the storage
+// backends don't, it's loaded on first use and saved when the cacher closes.
+func loadCacheIndex(storage Storage) (*CacheIndex, error) {
+	index := &CacheIndex{
+		Entries: make(map[string]*CacheEntry),
+		Counts:  make(map[string]*CacheCounts),
+	}
+
+	data, err := storage.Get(CacheIndexKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if data != nil {
+		err = json.Unmarshal(data, index)
+		if err != nil {
+			return nil, fmt.Errorf("error unmarshalling cache index: %v", err)
+		}
+	}
+
+	keys, err := storage.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	present := make(map[string]bool)
+	for _, key := range keys {
+		if key == CacheIndexKey {
+			continue
+		}
+
+		present[key] = true
+
+		if index.Entries[key] == nil {
+			data, err := storage.Get(key)
+			if err != nil {
+				return nil, err
+			}
+
+			index.Entries[key] = &CacheEntry{
+				Written:  now,
+				Accessed: now,
+				Size:     len(data),
+			}
+		}
+	}
+
+	for key := range index.Entries {
+		if !present[key] {
+			delete(index.Entries, key)
+		}
+	}
+
+	return index, nil
+}
+
+func (sc *SpotifyCacher) indexLocked() *CacheIndex {
+	if sc.index == nil {
+		index, err := loadCacheIndex(sc.storage)
+		if err != nil {
+			log.Printf("warning: rebuilding cache index: %v", err)
+			index = &CacheIndex{
+				Entries: make(map[string]*CacheEntry),
+				Counts:  make(map[string]*CacheCounts),
+			}
+		}
+		sc.index = index
+	}
+	return sc.index
+}
+
+func (sc *SpotifyCacher) expired(key string) bool {
+	if sc.policy == nil {
+		return false
+	}
+
+	ttl := sc.policy.TTLs[cacheKind(key)]
+	if ttl <= 0 {
+		return false
+	}
+
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	entry := sc.indexLocked().Entries[key]
+
+	return entry != nil && time.Since(entry.Written) > ttl
+}
+
+func (sc *SpotifyCacher) count(key string, hit bool) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	index := sc.indexLocked()
+	kind := cacheKind(key)
+	if index.Counts[kind] == nil {
+		index.Counts[kind] = &CacheCounts{}
+	}
+	if hit {
+		index.Counts[kind].Hits += 1
+	} else {
+		index.Counts[kind].Misses += 1
+	}
+}
+
+// usable is false for expired entries, unless offline where they're served
+// with a warning.
+func (sc *SpotifyCacher) usable(key string) bool {
+	if !sc.expired(key) {
+		return true
+	}
+
+	if !sc.policy.Offline {
+		return false
+	}
+
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	if sc.stale == 0 {
+		log.Printf("warning: offline, serving expired cache entries, starting with %v", key)
+	}
+	sc.stale += 1
+
+	return true
+}
+
+func (sc *SpotifyCacher) has(key string) bool {
+	return sc.storage.Has(key) && sc.usable(key)
+}
+
+func (sc *SpotifyCacher) get(key string) ([]byte, error) {
+	if !sc.usable(key) {
+		return nil, nil
+	}
+
+	data, err := sc.storage.Get(key)
+	if err != nil || data == nil {
+		return data, err
+	}
+
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	if entry := sc.indexLocked().Entries[key]; entry != nil {
+		entry.Accessed = time.Now()
+	}
+
+	return data, nil
+}
+
+func (sc *SpotifyCacher) put(key string, data []byte) error {
+	err := sc.storage.Put(key, data)
+	if err != nil {
+		return err
+	}
+
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	now := time.Now()
+	sc.indexLocked().Entries[key] = &CacheEntry{
+		Written:  now,
+		Accessed: now,
+		Size:     len(data),
+	}
+
+	return nil
+}
+
+func (sc *SpotifyCacher) remove(key string) error {
+	sc.lock.Lock()
+	delete(sc.cache, key)
+	if sc.index != nil {
+		delete(sc.index.Entries, key)
+	}
+	sc.lock.Unlock()
+
+	return sc.storage.Delete(key)
+}
+
+func (sc *SpotifyCacher) saveIndexLocked() error {
+	if sc.index == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(sc.index)
+	if err != nil {
+		return fmt.Errorf("error saving cache index: %v", err)
+	}
+
+	err = sc.storage.Put(CacheIndexKey, data)
+	if err != nil {
+		return fmt.Errorf("error saving cache index: %v", err)
+	}
+
+	return nil
+}
+
+// Evict removes the least recently used entries until the cache fits under
+// the policy's size limit. The playlist lists are kept, syncing needs them.
+func (sc *SpotifyCacher) Evict() (evicted int, err error) {
+	if sc.policy == nil || sc.policy.MaxSize <= 0 || sc.policy.Offline {
+		return 0, nil
+	}
+
+	sc.lock.Lock()
+	index := sc.indexLocked()
+
+	keys := make([]string, 0)
+	total := int64(0)
+	for key, entry := range index.Entries {
+		total += int64(entry.Size)
+		if cacheKind(key) != "playlists" {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return index.Entries[keys[i]].Accessed.Before(index.Entries[keys[j]].Accessed)
+	})
+
+	removing := make([]string, 0)
+	for _, key := range keys {
+		if total <= sc.policy.MaxSize {
+			break
+		}
+		total -= int64(index.Entries[key].Size)
+		removing = append(removing, key)
+	}
+	sc.lock.Unlock()
+
+	for _, key := range removing {
+		if err := sc.remove(key); err != nil {
+			return evicted, fmt.Errorf("error evicting %v: %v", key, err)
+		}
+		evicted += 1
+	}
+
+	if evicted > 0 {
+		log.Printf("cache: evicted %d entries over %d bytes", evicted, sc.policy.MaxSize)
+	}
+
+	return evicted, nil
+}
+
+func (sc *SpotifyCacher) Close() error {
+	if _, err := sc.Evict(); err != nil {
+		return err
+	}
+
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	if sc.stale > 0 {
+		log.Printf("cache: served %d expired entries offline", sc.stale)
+	}
+
+	return sc.saveIndexLocked()
+}
+
+func (sc *SpotifyCacher) read(key string, value interface{}) (bool, error) {
+	data, err := sc.storage.Get(key)
+	if err != nil || data == nil {
+		return false, err
+	}
+
+	err = json.Unmarshal(data, value)
+	if err != nil {
+		return false, fmt.Errorf("error unmarshalling %v: %v", key, err)
+	}
+
+	return true, nil
+}
+
+func (sc *SpotifyCacher) referenced() (map[string]bool, error) {
+	keys, err := sc.storage.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	refs := map[string]bool{
+		CacheIndexKey: true,
+	}
+
+	for _, key := range keys {
+		if cacheKind(key) != "playlists" {
+			continue
+		}
+
+		refs[key] = true
+
+		playlists := &PlaylistSet{}
+		if ok, err := sc.read(key, playlists); err != nil || !ok {
+			return nil, err
+		}
+
+		for _, pl := range playlists.Playlists {
+			tracksKey := fmt.Sprintf("playlist-%s", pl.ID)
+			refs[tracksKey] = true
+
+			tracks := make([]spotify.PlaylistTrack, 0)
+			if ok, err := sc.read(tracksKey, &tracks); err != nil {
+				return nil, err
+			} else if !ok {
+				continue
+			}
+
+			for _, t := range tracks {
+				refs[fmt.Sprintf("track-%s", t.Track.ID)] = true
+				refs[fmt.Sprintf("album-%s", t.Track.Album.ID)] = true
+				refs[fmt.Sprintf("album-tracks-%s", t.Track.Album.ID)] = true
+				for _, a := range t.Track.Artists {
+					refs[fmt.Sprintf("artist-albums-%s", a.ID)] = true
+				}
+			}
+		}
+	}
+
+	return refs, nil
+}
+
+// GarbageCollect removes entries that have expired or aren't reachable from
+// any cached playlist, then evicts down to the size limit.
+func (sc *SpotifyCacher) GarbageCollect() (removed int, err error) {
+	refs, err := sc.referenced()
+	if err != nil {
+		return 0, err
+	}
+
+	keys, err := sc.storage.Keys()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, key := range keys {
+		if refs[key] && !sc.expired(key) {
+			continue
+		}
+
+		if err := sc.remove(key); err != nil {
+			return removed, fmt.Errorf("error removing %v: %v", key, err)
+		}
+
+		removed += 1
+	}
+
+	evicted, err := sc.Evict()
+	if err != nil {
+		return removed, err
+	}
+
+	return removed + evicted, nil
+}
+
+type CacheKindStats struct {
+	Kind    string `json:"kind"`
+	Entries int    `json:"entries"`
+	Bytes   int64  `json:"bytes"`
+	Expired int    `json:"expired"`
+	Hits    int    `json:"hits"`
+	Misses  int    `json:"misses"`
+}
+
+func (s *CacheKindStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+func (sc *SpotifyCacher) Stats() []*CacheKindStats {
+	byKind := make(map[string]*CacheKindStats)
+	stats := func(kind string) *CacheKindStats {
+		if byKind[kind] == nil {
+			byKind[kind] = &CacheKindStats{Kind: kind}
+		}
+		return byKind[kind]
+	}
+
+	sc.lock.Lock()
+	index := sc.indexLocked()
+	entries := make(map[string]*CacheEntry)
+	for key, entry := range index.Entries {
+		entries[key] = entry
+	}
+	for kind, counts := range index.Counts {
+		stats(kind).Hits = counts.Hits
+		stats(kind).Misses = counts.Misses
+	}
+	sc.lock.Unlock()
+
+	for key, entry := range entries {
+		s := stats(cacheKind(key))
+		s.Entries += 1
+		s.Bytes += int64(entry.Size)
+		if sc.expired(key) {
+			s.Expired += 1
+		}
+	}
+
+	all := make([]*CacheKindStats, 0)
+	for _, s := range byKind {
+		all = append(all, s)
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Kind < all[j].Kind
+	})
+
+	return all
+}
+
+func WriteCacheStats(w io.Writer, stats []*CacheKindStats) {
+	total := &CacheKindStats{Kind: "total"}
+	for _, s := range stats {
+		total.Entries += s.Entries
+		total.Bytes += s.Bytes
+		total.Expired += s.Expired
+		total.Hits += s.Hits
+		total.Misses += s.Misses
+	}
+
+	fmt.Fprintf(w, "%-14s %8s %12s %8s %8s %8s %6s\n", "kind", "entries", "bytes", "expired", "hits", "misses", "ratio")
+	for _, s := range append(stats, total) {
+		fmt.Fprintf(w, "%-14s %8d %12d %8d %8d %8d %5.1f%%\n", s.Kind, s.Entries, s.Bytes, s.Expired, s.Hits, s.Misses, s.HitRatio()*100)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/zmb3/spotify"
+)
+
+func testCacher(t *testing.T, dir string, policy *CachePolicy) *SpotifyCacher {
+	storage, err := NewDirectoryStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewSpotifyCacher(storage, policy, &OfflineMusicService{}, false, 1)
+}
+
+func testPut(t *testing.T, sc *SpotifyCacher, key string, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.put(key, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testKeys(t *testing.T, sc *SpotifyCacher) []string {
+	keys, err := sc.storage.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestCacheOffline(t *testing.T) {
+	tests := []struct {
+		name    string
+		offline bool
+		served  bool
+		evicted int
+	}{
+		{"online", false, false, 1},
+		{"offline", true, true, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testTempDir(t)
+			defer os.RemoveAll(dir)
+
+			storage, err := NewDirectoryStorage(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			policy, err := ParseCachePolicy("track=1ns", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			policy.MaxSize = 1
+			policy.Offline = test.offline
+
+			sc := NewSpotifyCacher(storage, policy, &OfflineMusicService{}, false, 1)
+			if err := sc.put("track-a", []byte(`{"id":"a"}`)); err != nil {
+				t.Fatal(err)
+			}
+
+			time.Sleep(time.Millisecond)
+
+			data, err := sc.get("track-a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if served := data != nil; served != test.served {
+				t.Errorf("expected served %v, got %v", test.served, served)
+			}
+			if has := sc.has("track-a"); has != test.served {
+				t.Errorf("expected has %v, got %v", test.served, has)
+			}
+
+			evicted, err := sc.Evict()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if evicted != test.evicted {
+				t.Errorf("expected %d evicted, got %d", test.evicted, evicted)
+			}
+		})
+	}
+}
+
+func TestParseCachePolicy(t *testing.T) {
+	tests := []struct {
+		ttls  string
+		fails bool
+		track time.Duration
+	}{
+		{"", false, DefaultCacheTTLs["track"]},
+		{"track=1h, album=0", false, time.Hour},
+		{"playlists=24h", false, DefaultCacheTTLs["track"]},
+		{"other=1h", true, 0},
+		{"tracks=1h", true, 0},
+		{"track", true, 0},
+		{"track=soon", true, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.ttls, func(t *testing.T) {
+			policy, err := ParseCachePolicy(test.ttls, 1)
+			if test.fails {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if policy.TTLs["track"] != test.track {
+				t.Errorf("expected track ttl %v, got %v", test.track, policy.TTLs["track"])
+			}
+			if policy.MaxSize != 1024*1024 {
+				t.Errorf("expected 1MB, got %d", policy.MaxSize)
+			}
+		})
+	}
+}
+
+func TestCacheGarbageCollect(t *testing.T) {
+	dir := testTempDir(t)
+	defer os.RemoveAll(dir)
+
+	policy, err := ParseCachePolicy("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sc := testCacher(t, dir, policy)
+
+	testPut(t, sc, "playlists-tester", &PlaylistSet{Playlists: []Playlist{{ID: "pl", Name: "Playlist"}}})
+	testPut(t, sc, "playlist-pl", []spotify.PlaylistTrack{
+		testTrack("t0", "artist", "album", testEpoch),
+		testTrack("t1", "artist", "album", testEpoch),
+	})
+	for _, key := range []string{"track-t0", "track-t1", "album-album", "album-tracks-album", "artist-albums-artist"} {
+		testPut(t, sc, key, map[string]string{})
+	}
+	for _, key := range []string{"track-orphan", "album-orphan", "playlist-gone", "artist-albums-gone"} {
+		testPut(t, sc, key, map[string]string{})
+	}
+
+	// Reachable, but written before its TTL.
+	sc.indexLocked().Entries["track-t1"].Written = time.Now().Add(-2 * DefaultCacheTTLs["track"])
+
+	removed, err := sc.GarbageCollect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 5 {
+		t.Errorf("expected 5 removed, got %d", removed)
+	}
+
+	expected := []string{"album-album", "album-tracks-album", "artist-albums-artist", "playlist-pl", "playlists-tester", "track-t0"}
+	if keys := testKeys(t, sc); !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected %v, got %v", expected, keys)
+	}
+}
+
+func TestCacheEvict(t *testing.T) {
+	dir := testTempDir(t)
+	defer os.RemoveAll(dir)
+
+	sc := testCacher(t, dir, &CachePolicy{MaxSize: 25})
+
+	for _, key := range []string{"playlists-tester", "track-a", "track-b", "track-c"} {
+		if err := sc.put(key, []byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Accessed oldest first: the playlists, b, c and then a.
+	accessed := map[string]time.Duration{"playlists-tester": 4, "track-b": 3, "track-c": 2, "track-a": 1}
+	for key, ago := range accessed {
+		sc.indexLocked().Entries[key].Accessed = time.Now().Add(-ago * time.Hour)
+	}
+
+	evicted, err := sc.Evict()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evicted != 2 {
+		t.Errorf("expected 2 evicted, got %d", evicted)
+	}
+
+	expected := []string{"playlists-tester", "track-a"}
+	if keys := testKeys(t, sc); !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected %v, got %v", expected, keys)
+	}
+}
@@ -2,9 +2,8 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
 	"log"
-	"os"
+	"sync"
 	_ "time"
 
 	"encoding/json"
@@ -14,54 +13,125 @@ import (
 
 const VerboseLogging = false
 
+const SpotifyTracksBatchSize = 50
+
 type SpotifyCacher struct {
+	lock          sync.Mutex
 	cache         map[string]interface{}
-	spotifyClient *spotify.Client
+	storage       Storage
+	policy        *CachePolicy
+	index         *CacheIndex
+	spotifyClient MusicService
 	refresh       bool
+	concurrency   int
+	stale         int
 }
 
-func NewSpotifyCacher(spotifyClient *spotify.Client, refresh bool) *SpotifyCacher {
+func NewSpotifyCacher(storage Storage, policy *CachePolicy, spotifyClient MusicService, refresh bool, concurrency int) *SpotifyCacher {
 	return &SpotifyCacher{
 		cache:         make(map[string]interface{}),
+		storage:       storage,
+		policy:        policy,
 		spotifyClient: spotifyClient,
 		refresh:       refresh,
+		concurrency:   concurrency,
 	}
 }
 
-func (sc *SpotifyCacher) lookup(path string, value interface{}) (interface{}, error) {
-	if sc.cache[path] != nil {
-		value = sc.cache[path]
-		return value, nil
+// OpenSpotifyCacher locks and opens the cache storage, the returned function
+// saves the cache index and releases them.
+func OpenSpotifyCacher(options *Options, spotifyClient MusicService) (*SpotifyCacher, func() error, error) {
+	policy, err := ParseCachePolicy(options.CacheTTL, options.CacheMaxMB)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	if _, err := os.Stat(path); !os.IsNotExist(err) {
-		file, err := ioutil.ReadFile(path)
-		if err != nil {
-			return nil, fmt.Errorf("error reading: %v", err)
-		}
+	policy.Offline = options.Offline
+
+	lock, err := LockStorage(options.Cache)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	storage, err := OpenStorage(options.Cache)
+	if err != nil {
+		lock.Unlock()
+		return nil, nil, err
+	}
+
+	cacher := NewSpotifyCacher(storage, policy, spotifyClient, options.Refresh, options.Concurrency)
+
+	closing := func() error {
+		defer lock.Unlock()
+		defer storage.Close()
 
+		return cacher.Close()
+	}
+
+	return cacher, closing, nil
+}
+
+func (sc *SpotifyCacher) cached(key string) interface{} {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	return sc.cache[key]
+}
+
+func (sc *SpotifyCacher) lookup(key string, value interface{}) (interface{}, error) {
+	if cached := sc.cached(key); cached != nil {
+		sc.count(key, true)
+		return cached, nil
+	}
+
+	file, err := sc.get(key)
+	if err != nil {
+		return nil, fmt.Errorf("error reading: %v", err)
+	}
+
+	if file != nil {
 		err = json.Unmarshal(file, value)
 		if err != nil {
-			return nil, fmt.Errorf("error unmarshalling: %v", err)
+			return nil, sc.discard(key, err)
 		}
 
+		sc.count(key, true)
+
 		if VerboseLogging {
-			log.Printf("returning cached %v %v", path)
+			log.Printf("returning cached %v", key)
 		}
 
-		sc.cache[path] = value
+		sc.lock.Lock()
+		sc.cache[key] = value
+		sc.lock.Unlock()
 
 		return value, nil
 	}
 
+	sc.count(key, false)
+
 	return nil, nil
 }
 
+// Corrupted entries, say from an interrupted write before they were atomic,
+// are dropped so they're fetched again.
+func (sc *SpotifyCacher) discard(key string, err error) error {
+	log.Printf("warning: discarding corrupted cache entry %v: %v", key, err)
+
+	sc.count(key, false)
+
+	if err := sc.remove(key); err != nil {
+		return fmt.Errorf("error removing corrupted %v: %v", key, err)
+	}
+
+	return nil
+}
+
 func (sc *SpotifyCacher) GetPlaylists(user string) (playlists *PlaylistSet, err error) {
-	cachedFile := fmt.Sprintf(".cache/playlists-%s.json", user)
+	key := fmt.Sprintf("playlists-%s", user)
 	if !sc.refresh {
 		playlists = &PlaylistSet{}
-		cached, err := sc.lookup(cachedFile, playlists)
+		cached, err := sc.lookup(key, playlists)
 		if err != nil {
 			return nil, err
 		}
@@ -70,6 +140,12 @@ func (sc *SpotifyCacher) GetPlaylists(user string) (playlists *PlaylistSet, err
 		}
 	}
 
+	return sc.fetchPlaylists(user)
+}
+
+func (sc *SpotifyCacher) fetchPlaylists(user string) (playlists *PlaylistSet, err error) {
+	key := fmt.Sprintf("playlists-%s", user)
+
 	limit := 50
 	offset := 0
 	options := spotify.Options{Limit: &limit, Offset: &offset}
@@ -114,33 +190,37 @@ func (sc *SpotifyCacher) GetPlaylists(user string) (playlists *PlaylistSet, err
 		return nil, fmt.Errorf("error saving Playlists: %v", err)
 	}
 
-	err = ioutil.WriteFile(cachedFile, json, 0644)
+	err = sc.put(key, json)
 	if err != nil {
 		return nil, fmt.Errorf("error saving Playlists: %v", err)
 	}
 
+	sc.lock.Lock()
+	sc.cache[key] = playlists
+	sc.lock.Unlock()
+
 	return
 }
 
 func (sc *SpotifyCacher) InvalidateUser(user string) {
-	cachedFile := fmt.Sprintf(".cache/playlists-%s.json", user)
-	os.Remove(cachedFile)
+	key := fmt.Sprintf("playlists-%s", user)
+	sc.remove(key)
 
 	log.Printf("invalidating playlists %v", user)
 }
 
 func (sc *SpotifyCacher) Invalidate(id spotify.ID) {
-	cachedFile := fmt.Sprintf(".cache/playlist-%s.json", id)
-	os.Remove(cachedFile)
+	key := fmt.Sprintf("playlist-%s", id)
+	sc.remove(key)
 
 	log.Printf("invalidating playlist %v", id)
 }
 
 func (sc *SpotifyCacher) GetPlaylistTracks(userId string, id spotify.ID) (allTracks []spotify.PlaylistTrack, err error) {
-	cachedFile := fmt.Sprintf(".cache/playlist-%s.json", id)
+	key := fmt.Sprintf("playlist-%s", id)
 	if !sc.refresh {
 		allTracks = make([]spotify.PlaylistTrack, 0)
-		cached, err := sc.lookup(cachedFile, &allTracks)
+		cached, err := sc.lookup(key, &allTracks)
 		if err != nil {
 			return nil, err
 		}
@@ -160,7 +240,7 @@ func (sc *SpotifyCacher) GetPlaylistTracks(userId string, id spotify.ID) (allTra
 		return nil, fmt.Errorf("error saving playlist tracks: %v", err)
 	}
 
-	err = ioutil.WriteFile(cachedFile, json, 0644)
+	err = sc.put(key, json)
 	if err != nil {
 		return nil, fmt.Errorf("error saving playlist tracks: %v", err)
 	}
@@ -168,17 +248,54 @@ func (sc *SpotifyCacher) GetPlaylistTracks(userId string, id spotify.ID) (allTra
 	return
 }
 
-func (sc *SpotifyCacher) GetAlbum(id spotify.ID) (album *spotify.FullAlbum, err error) {
-	cachedFile := fmt.Sprintf(".cache/album-%s.json", id)
-	if _, err := os.Stat(cachedFile); !os.IsNotExist(err) {
-		var album *spotify.FullAlbum
-		cached, err := sc.lookup(cachedFile, album)
+// GetPlaylistsTracks fetches the tracks of several playlists at once, using
+// up to the cacher's concurrency in parallel requests.
+func (sc *SpotifyCacher) GetPlaylistsTracks(userId string, playlists []Playlist) (map[spotify.ID][]spotify.PlaylistTrack, error) {
+	var lock sync.Mutex
+	all := make(map[spotify.ID][]spotify.PlaylistTrack)
+
+	err := Parallel(sc.concurrency, len(playlists), func(i int) error {
+		tracks, err := sc.GetPlaylistTracks(userId, playlists[i].ID)
 		if err != nil {
-			return nil, err
-		}
-		if cached != nil {
-			return cached.(*spotify.FullAlbum), nil
+			return err
 		}
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		all[playlists[i].ID] = tracks
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return all, nil
+}
+
+func (sc *SpotifyCacher) GetAlbums(ids []spotify.ID) ([]*spotify.FullAlbum, error) {
+	albums := make([]*spotify.FullAlbum, len(ids))
+
+	err := Parallel(sc.concurrency, len(ids), func(i int) (err error) {
+		albums[i], err = sc.GetAlbum(ids[i])
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return albums, nil
+}
+
+func (sc *SpotifyCacher) GetAlbum(id spotify.ID) (album *spotify.FullAlbum, err error) {
+	key := fmt.Sprintf("album-%s", id)
+	cached, err := sc.lookup(key, &spotify.FullAlbum{})
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil {
+		return cached.(*spotify.FullAlbum), nil
 	}
 
 	album, spotifyErr := sc.spotifyClient.GetAlbum(id)
@@ -192,7 +309,7 @@ func (sc *SpotifyCacher) GetAlbum(id spotify.ID) (album *spotify.FullAlbum, err
 		return nil, fmt.Errorf("error saving album tracks: %v", err)
 	}
 
-	err = ioutil.WriteFile(cachedFile, json, 0644)
+	err = sc.put(key, json)
 	if err != nil {
 		return nil, fmt.Errorf("error saving album tracks: %v", err)
 	}
@@ -201,16 +318,13 @@ func (sc *SpotifyCacher) GetAlbum(id spotify.ID) (album *spotify.FullAlbum, err
 }
 
 func (sc *SpotifyCacher) GetAlbumTracks(id spotify.ID) (allTracks []spotify.SimpleTrack, err error) {
-	cachedFile := fmt.Sprintf(".cache/album-tracks-%s.json", id)
-	if _, err := os.Stat(cachedFile); !os.IsNotExist(err) {
-		allTracks := make([]spotify.SimpleTrack, 0)
-		cached, err := sc.lookup(cachedFile, &allTracks)
-		if err != nil {
-			return nil, err
-		}
-		if cached != nil {
-			return *(cached.(*[]spotify.SimpleTrack)), nil
-		}
+	key := fmt.Sprintf("album-tracks-%s", id)
+	cached, err := sc.lookup(key, &[]spotify.SimpleTrack{})
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil {
+		return *(cached.(*[]spotify.SimpleTrack)), nil
 	}
 
 	allTracks, spotifyErr := GetAlbumTracks(sc.spotifyClient, id)
@@ -224,7 +338,7 @@ func (sc *SpotifyCacher) GetAlbumTracks(id spotify.ID) (allTracks []spotify.Simp
 		return nil, fmt.Errorf("error saving album tracks: %v", err)
 	}
 
-	err = ioutil.WriteFile(cachedFile, json, 0644)
+	err = sc.put(key, json)
 	if err != nil {
 		return nil, fmt.Errorf("error saving album tracks: %v", err)
 	}
@@ -233,16 +347,13 @@ func (sc *SpotifyCacher) GetAlbumTracks(id spotify.ID) (allTracks []spotify.Simp
 }
 
 func (sc *SpotifyCacher) GetArtistAlbums(id spotify.ID) (allAlbums []spotify.SimpleAlbum, err error) {
-	cachedFile := fmt.Sprintf(".cache/artist-albums-%s.json", id)
-	if _, err := os.Stat(cachedFile); !os.IsNotExist(err) {
-		allAlbums := make([]spotify.SimpleAlbum, 0)
-		cached, err := sc.lookup(cachedFile, &allAlbums)
-		if err != nil {
-			return nil, err
-		}
-		if cached != nil {
-			return *(cached.(*[]spotify.SimpleAlbum)), nil
-		}
+	key := fmt.Sprintf("artist-albums-%s", id)
+	cached, err := sc.lookup(key, &[]spotify.SimpleAlbum{})
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil {
+		return *(cached.(*[]spotify.SimpleAlbum)), nil
 	}
 
 	allAlbums, spotifyErr := GetArtistAlbums(sc.spotifyClient, id)
@@ -256,7 +367,7 @@ func (sc *SpotifyCacher) GetArtistAlbums(id spotify.ID) (allAlbums []spotify.Sim
 		return nil, fmt.Errorf("error saving artist albums: %v", err)
 	}
 
-	err = ioutil.WriteFile(cachedFile, json, 0644)
+	err = sc.put(key, json)
 	if err != nil {
 		return nil, fmt.Errorf("error saving artist albums: %v", err)
 	}
@@ -265,57 +376,82 @@ func (sc *SpotifyCacher) GetArtistAlbums(id spotify.ID) (allAlbums []spotify.Sim
 }
 
 func (sc *SpotifyCacher) GetTracks(ids []spotify.ID) (tracks []spotify.FullTrack, err error) {
+	var lock sync.Mutex
+	found := make(map[spotify.ID]spotify.FullTrack)
 	requesting := make([]spotify.ID, 0)
+
 	for _, id := range ids {
-		cachedFile := fmt.Sprintf(".cache/track-%s.json", id)
-		if _, err := os.Stat(cachedFile); os.IsNotExist(err) {
-			requesting = append(requesting, id)
+		key := fmt.Sprintf("track-%s", id)
+		file, err := sc.get(key)
+		if err != nil {
+			return nil, fmt.Errorf("error opening %v", err)
 		}
+
+		if file != nil {
+			var track spotify.FullTrack
+			err = json.Unmarshal(file, &track)
+			if err == nil {
+				sc.count(key, true)
+				found[id] = track
+
+				if VerboseLogging {
+					log.Printf("returning cached %s", key)
+				}
+
+				continue
+			}
+
+			if err := sc.discard(key, err); err != nil {
+				return nil, err
+			}
+		} else {
+			sc.count(key, false)
+		}
+
+		requesting = append(requesting, id)
 	}
 
-	if len(requesting) > 0 {
-		requested, spotifyErr := sc.spotifyClient.GetTracks(requesting...)
-		if spotifyErr != nil {
-			err = spotifyErr
-			return
+	batches := (len(requesting) + SpotifyTracksBatchSize - 1) / SpotifyTracksBatchSize
+	err = Parallel(sc.concurrency, batches, func(i int) error {
+		batch := requesting[i*SpotifyTracksBatchSize : min((i+1)*SpotifyTracksBatchSize, len(requesting))]
+		requested, err := sc.spotifyClient.GetTracks(batch...)
+		if err != nil {
+			return err
 		}
 
 		for _, track := range requested {
-			cachedFile := fmt.Sprintf(".cache/track-%s.json", track.ID)
+			if track == nil {
+				continue
+			}
+
+			key := fmt.Sprintf("track-%s", track.ID)
 
 			json, err := json.Marshal(track)
 			if err != nil {
-				return nil, fmt.Errorf("error saving track: %v", err)
+				return fmt.Errorf("error saving track: %v", err)
 			}
 
-			err = ioutil.WriteFile(cachedFile, json, 0644)
+			err = sc.put(key, json)
 			if err != nil {
-				return nil, fmt.Errorf("error saving track: %v", err)
+				return fmt.Errorf("error saving track: %v", err)
 			}
+
+			lock.Lock()
+			found[track.ID] = *track
+			lock.Unlock()
 		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	tracks = make([]spotify.FullTrack, 0)
 
 	for _, id := range ids {
-		cachedFile := fmt.Sprintf(".cache/track-%s.json", id)
-		if _, err := os.Stat(cachedFile); !os.IsNotExist(err) {
-			file, err := ioutil.ReadFile(cachedFile)
-			if err != nil {
-				return nil, fmt.Errorf("error opening %v", err)
-			}
-
-			var track spotify.FullTrack
-			err = json.Unmarshal(file, &track)
-			if err != nil {
-				return nil, fmt.Errorf("error unmarshalling %v", err)
-			}
-
+		if track, ok := found[id]; ok {
 			tracks = append(tracks, track)
-
-			if VerboseLogging {
-				log.Printf("returning cached %s", cachedFile)
-			}
 		}
 	}
 
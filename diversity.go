@@ -0,0 +1,124 @@
+package main
+
+import (
+	"log"
+
+	"github.com/zmb3/spotify"
+)
+
+type Constraints struct {
+	MaxPerArtist int
+	MaxPerAlbum  int
+	MinArtistGap int
+}
+
+func artistIds(c *Candidate) []spotify.ID {
+	ids := make([]spotify.ID, 0)
+	for _, a := range c.Track.Track.Artists {
+		if len(a.ID) > 0 {
+			ids = append(ids, a.ID)
+		}
+	}
+	return ids
+}
+
+type constrainedSelection struct {
+	constraints *Constraints
+	artists     map[spotify.ID]int
+	albums      map[spotify.ID]int
+	lastArtist  map[spotify.ID]int
+	selected    []*Candidate
+}
+
+func (cs *constrainedSelection) allowed(c *Candidate, gap bool) bool {
+	for _, id := range artistIds(c) {
+		if cs.constraints.MaxPerArtist > 0 && cs.artists[id] >= cs.constraints.MaxPerArtist {
+			return false
+		}
+		if gap && cs.constraints.MinArtistGap > 0 {
+			if last, ok := cs.lastArtist[id]; ok && len(cs.selected)-last <= cs.constraints.MinArtistGap {
+				return false
+			}
+		}
+	}
+
+	album := c.Track.Track.Album.ID
+	if cs.constraints.MaxPerAlbum > 0 && len(album) > 0 && cs.albums[album] >= cs.constraints.MaxPerAlbum {
+		return false
+	}
+
+	return true
+}
+
+func (cs *constrainedSelection) add(c *Candidate) {
+	for _, id := range artistIds(c) {
+		cs.artists[id] += 1
+		cs.lastArtist[id] = len(cs.selected)
+	}
+	if len(c.Track.Track.Album.ID) > 0 {
+		cs.albums[c.Track.Track.Album.ID] += 1
+	}
+	cs.selected = append(cs.selected, c)
+}
+
+// Apply selects number tracks to follow the kept ones, which come first in
+// the playlist and so count against the caps and the artist gap.
+func (con *Constraints) Apply(pool *CandidatePool, ordered *TracksSet, kept []*Candidate, number int) *TracksSet {
+	cs := &constrainedSelection{
+		constraints: con,
+		artists:     make(map[spotify.ID]int),
+		albums:      make(map[spotify.ID]int),
+		lastArtist:  make(map[spotify.ID]int),
+		selected:    make([]*Candidate, 0),
+	}
+
+	for _, c := range kept {
+		cs.add(c)
+	}
+
+	number += len(kept)
+
+	remaining := make([]*Candidate, 0, len(ordered.Ordered))
+	for _, id := range ordered.ToArray() {
+		if c := pool.Get(id); c != nil {
+			remaining = append(remaining, c)
+		}
+	}
+
+	for len(cs.selected) < number {
+		picked := -1
+		for i, c := range remaining {
+			if cs.allowed(c, true) {
+				picked = i
+				break
+			}
+		}
+
+		if picked < 0 {
+			for i, c := range remaining {
+				if cs.allowed(c, false) {
+					log.Printf("warning: unable to keep artist gap at position %d", len(cs.selected))
+					picked = i
+					break
+				}
+			}
+		}
+
+		if picked < 0 {
+			break
+		}
+
+		cs.add(remaining[picked])
+		remaining = append(remaining[:picked], remaining[picked+1:]...)
+	}
+
+	if len(cs.selected) < number {
+		log.Printf("warning: only %d tracks satisfy constraints, wanted %d", len(cs.selected)-len(kept), number-len(kept))
+	}
+
+	selected := NewEmptyTracksSet()
+	for _, c := range cs.selected[len(kept):] {
+		selected.Add(c.ID)
+	}
+	return selected
+}
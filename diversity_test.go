@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/zmb3/spotify"
+)
+
+func testCandidates(tracks ...spotify.PlaylistTrack) []*Candidate {
+	candidates := make([]*Candidate, 0)
+	for _, t := range tracks {
+		candidates = append(candidates, &Candidate{ID: t.Track.ID, Track: t})
+	}
+	return candidates
+}
+
+func TestConstraintsApply(t *testing.T) {
+	pool := NewCandidatePool()
+	pool.Add(Playlist{}, []spotify.PlaylistTrack{
+		testTrack("a1", "a", "x", testEpoch),
+		testTrack("a2", "a", "y", testEpoch),
+		testTrack("b1", "b", "x", testEpoch),
+		testTrack("b2", "b", "z", testEpoch),
+		testTrack("c1", "c", "z", testEpoch),
+		testTrack("c2", "c", "w", testEpoch),
+	})
+	ordered := NewTracksSet(splitIds("a1 a2 b1 b2 c1 c2"))
+
+	tests := []struct {
+		name        string
+		constraints Constraints
+		kept        []*Candidate
+		number      int
+		expected    string
+	}{
+		{"unconstrained", Constraints{}, nil, 4, "a1 a2 b1 b2"},
+		{"artist cap", Constraints{MaxPerArtist: 1}, nil, 4, "a1 b1 c1"},
+		{"album cap", Constraints{MaxPerAlbum: 1}, nil, 4, "a1 a2 b2 c2"},
+		{"artist gap", Constraints{MinArtistGap: 1}, nil, 4, "a1 b1 a2 b2"},
+		{"kept count against artist cap", Constraints{MaxPerArtist: 1}, testCandidates(testTrack("k1", "a", "k", testEpoch)), 3, "b1 c1"},
+		{"kept count against album cap", Constraints{MaxPerAlbum: 1}, testCandidates(testTrack("k1", "k", "x", testEpoch)), 3, "a2 b2 c2"},
+		{"kept count against artist gap", Constraints{MinArtistGap: 1}, testCandidates(testTrack("k1", "a", "k", testEpoch)), 3, "b1 a1 b2"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			selected := test.constraints.Apply(pool, ordered, test.kept, test.number)
+			if expected := splitIds(test.expected); !reflect.DeepEqual(selected.ToArray(), expected) {
+				t.Errorf("expected %v, got %v", expected, selected.ToArray())
+			}
+		})
+	}
+}
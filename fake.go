@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/zmb3/spotify"
+)
+
+type FakePlaylist struct {
+	Playlist spotify.SimplePlaylist  `json:"playlist"`
+	Tracks   []spotify.PlaylistTrack `json:"tracks"`
+}
+
+type FakeFixture struct {
+	User         string                               `json:"user"`
+	Playlists    []*FakePlaylist                      `json:"playlists"`
+	Albums       []*spotify.FullAlbum                 `json:"albums"`
+	AlbumTracks  map[spotify.ID][]spotify.SimpleTrack `json:"albumTracks"`
+	ArtistAlbums map[spotify.ID][]spotify.SimpleAlbum `json:"artistAlbums"`
+	Tracks       []*spotify.FullTrack                 `json:"tracks"`
+}
+
+type FakeMusicService struct {
+	lock     sync.Mutex
+	fixture  *FakeFixture
+	snapshot int
+	Calls    []string
+}
+
+func NewFakeMusicService(fixture *FakeFixture) *FakeMusicService {
+	if fixture.AlbumTracks == nil {
+		fixture.AlbumTracks = make(map[spotify.ID][]spotify.SimpleTrack)
+	}
+	if fixture.ArtistAlbums == nil {
+		fixture.ArtistAlbums = make(map[spotify.ID][]spotify.SimpleAlbum)
+	}
+
+	return &FakeMusicService{
+		fixture: fixture,
+		Calls:   make([]string, 0),
+	}
+}
+
+func LoadFakeMusicService(path string) (*FakeMusicService, error) {
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading fixture: %v", err)
+	}
+
+	fixture := &FakeFixture{}
+	err = json.Unmarshal(file, fixture)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling fixture: %v", err)
+	}
+
+	return NewFakeMusicService(fixture), nil
+}
+
+func (f *FakeMusicService) call(format string, args ...interface{}) {
+	f.Calls = append(f.Calls, fmt.Sprintf(format, args...))
+}
+
+func (f *FakeMusicService) playlist(id spotify.ID) (*FakePlaylist, error) {
+	for _, pl := range f.fixture.Playlists {
+		if pl.Playlist.ID == id {
+			return pl, nil
+		}
+	}
+	return nil, fmt.Errorf("fake: no such playlist %v", id)
+}
+
+func (f *FakeMusicService) changed(pl *FakePlaylist) string {
+	f.snapshot += 1
+	pl.Playlist.SnapshotID = fmt.Sprintf("fake-%d", f.snapshot)
+	pl.Playlist.Tracks.Total = uint(len(pl.Tracks))
+	return pl.Playlist.SnapshotID
+}
+
+func (f *FakeMusicService) track(id spotify.ID) spotify.FullTrack {
+	for _, t := range f.fixture.Tracks {
+		if t.ID == id {
+			return *t
+		}
+	}
+	for _, pl := range f.fixture.Playlists {
+		for _, t := range pl.Tracks {
+			if t.Track.ID == id {
+				return t.Track
+			}
+		}
+	}
+	t := spotify.FullTrack{}
+	t.ID = id
+	return t
+}
+
+func paging(opt *spotify.Options, total int) (offset, end int) {
+	limit := 20
+	if opt != nil && opt.Limit != nil {
+		limit = *opt.Limit
+	}
+	if opt != nil && opt.Offset != nil {
+		offset = *opt.Offset
+	}
+	return min(offset, total), min(offset+limit, total)
+}
+
+func (f *FakeMusicService) CurrentUser() (*spotify.PrivateUser, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.call("CurrentUser")
+
+	user := &spotify.PrivateUser{}
+	user.ID = f.fixture.User
+	return user, nil
+}
+
+func (f *FakeMusicService) GetPlaylistsForUserOpt(userID string, opt *spotify.Options) (*spotify.SimplePlaylistPage, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.call("GetPlaylistsForUserOpt %s", userID)
+
+	offset, end := paging(opt, len(f.fixture.Playlists))
+	page := &spotify.SimplePlaylistPage{
+		Playlists: make([]spotify.SimplePlaylist, 0),
+	}
+	page.Offset = offset
+	page.Total = len(f.fixture.Playlists)
+	for _, pl := range f.fixture.Playlists[offset:end] {
+		page.Playlists = append(page.Playlists, pl.Playlist)
+	}
+	return page, nil
+}
+
+func (f *FakeMusicService) GetPlaylistTracksOpt(playlistID spotify.ID, opt *spotify.Options, fields string) (*spotify.PlaylistTrackPage, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.call("GetPlaylistTracksOpt %s", playlistID)
+
+	pl, err := f.playlist(playlistID)
+	if err != nil {
+		return nil, err
+	}
+
+	offset, end := paging(opt, len(pl.Tracks))
+	page := &spotify.PlaylistTrackPage{
+		Tracks: append([]spotify.PlaylistTrack{}, pl.Tracks[offset:end]...),
+	}
+	page.Offset = offset
+	page.Total = len(pl.Tracks)
+	return page, nil
+}
+
+func (f *FakeMusicService) CreatePlaylistForUser(userID, playlistName, description string, public bool) (*spotify.FullPlaylist, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.call("CreatePlaylistForUser %s %s", userID, playlistName)
+
+	pl := &FakePlaylist{
+		Tracks: make([]spotify.PlaylistTrack, 0),
+	}
+	pl.Playlist.ID = spotify.ID(fmt.Sprintf("fake%d", len(f.fixture.Playlists)))
+	pl.Playlist.Name = playlistName
+	pl.Playlist.IsPublic = public
+	pl.Playlist.Owner.ID = userID
+	f.changed(pl)
+
+	f.fixture.Playlists = append(f.fixture.Playlists, pl)
+
+	return &spotify.FullPlaylist{
+		SimplePlaylist: pl.Playlist,
+		Description:    description,
+	}, nil
+}
+
+func (f *FakeMusicService) AddTracksToPlaylist(playlistID spotify.ID, trackIDs ...spotify.ID) (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.call("AddTracksToPlaylist %s %d", playlistID, len(trackIDs))
+
+	pl, err := f.playlist(playlistID)
+	if err != nil {
+		return "", err
+	}
+
+	addedAt := time.Now().UTC().Format("2006-01-02T15:04:05Z")
+	for _, id := range trackIDs {
+		pl.Tracks = append(pl.Tracks, spotify.PlaylistTrack{
+			AddedAt: addedAt,
+			Track:   f.track(id),
+		})
+	}
+
+	return f.changed(pl), nil
+}
+
+func (f *FakeMusicService) RemoveTracksFromPlaylist(playlistID spotify.ID, trackIDs ...spotify.ID) (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.call("RemoveTracksFromPlaylist %s %d", playlistID, len(trackIDs))
+
+	pl, err := f.playlist(playlistID)
+	if err != nil {
+		return "", err
+	}
+
+	removing := NewTracksSet(trackIDs)
+	tracks := make([]spotify.PlaylistTrack, 0)
+	for _, t := range pl.Tracks {
+		if !removing.Contains(t.Track.ID) {
+			tracks = append(tracks, t)
+		}
+	}
+	pl.Tracks = tracks
+
+	return f.changed(pl), nil
+}
+
+func (f *FakeMusicService) ReorderPlaylistTracks(playlistID spotify.ID, opt spotify.PlaylistReorderOptions) (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.call("ReorderPlaylistTracks %s %d %d %d", playlistID, opt.RangeStart, opt.RangeLength, opt.InsertBefore)
+
+	pl, err := f.playlist(playlistID)
+	if err != nil {
+		return "", err
+	}
+
+	length := opt.RangeLength
+	if length == 0 {
+		length = 1
+	}
+
+	if opt.RangeStart < 0 || opt.RangeStart+length > len(pl.Tracks) || opt.InsertBefore < 0 || opt.InsertBefore > len(pl.Tracks) {
+		return "", fmt.Errorf("fake: invalid reorder %+v of %d tracks", opt, len(pl.Tracks))
+	}
+
+	moving := append([]spotify.PlaylistTrack{}, pl.Tracks[opt.RangeStart:opt.RangeStart+length]...)
+	remaining := append([]spotify.PlaylistTrack{}, pl.Tracks[:opt.RangeStart]...)
+	remaining = append(remaining, pl.Tracks[opt.RangeStart+length:]...)
+
+	insertAt := opt.InsertBefore
+	if insertAt > opt.RangeStart {
+		insertAt -= length
+		if insertAt < opt.RangeStart {
+			insertAt = opt.RangeStart
+		}
+	}
+
+	tracks := append([]spotify.PlaylistTrack{}, remaining[:insertAt]...)
+	tracks = append(tracks, moving...)
+	tracks = append(tracks, remaining[insertAt:]...)
+	pl.Tracks = tracks
+
+	return f.changed(pl), nil
+}
+
+func (f *FakeMusicService) ReplacePlaylistTracks(playlistID spotify.ID, trackIDs ...spotify.ID) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.call("ReplacePlaylistTracks %s %d", playlistID, len(trackIDs))
+
+	if len(trackIDs) > 100 {
+		return fmt.Errorf("fake: replace supports up to 100 tracks")
+	}
+
+	pl, err := f.playlist(playlistID)
+	if err != nil {
+		return err
+	}
+
+	addedAt := time.Now().UTC().Format("2006-01-02T15:04:05Z")
+	pl.Tracks = make([]spotify.PlaylistTrack, 0)
+	for _, id := range trackIDs {
+		pl.Tracks = append(pl.Tracks, spotify.PlaylistTrack{
+			AddedAt: addedAt,
+			Track:   f.track(id),
+		})
+	}
+
+	f.changed(pl)
+
+	return nil
+}
+
+func (f *FakeMusicService) GetAlbum(id spotify.ID) (*spotify.FullAlbum, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.call("GetAlbum %s", id)
+
+	for _, album := range f.fixture.Albums {
+		if album.ID == id {
+			return album, nil
+		}
+	}
+	return nil, fmt.Errorf("fake: no such album %v", id)
+}
+
+func (f *FakeMusicService) GetAlbumTracksOpt(id spotify.ID, opt *spotify.Options) (*spotify.SimpleTrackPage, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.call("GetAlbumTracksOpt %s", id)
+
+	all := f.fixture.AlbumTracks[id]
+	start, end := paging(opt, len(all))
+	page := &spotify.SimpleTrackPage{
+		Tracks: append([]spotify.SimpleTrack{}, all[start:end]...),
+	}
+	page.Offset = start
+	page.Total = len(all)
+	return page, nil
+}
+
+func (f *FakeMusicService) GetArtistAlbumsOpt(artistID spotify.ID, options *spotify.Options, ts ...spotify.AlbumType) (*spotify.SimpleAlbumPage, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.call("GetArtistAlbumsOpt %s", artistID)
+
+	all := f.fixture.ArtistAlbums[artistID]
+	start, end := paging(options, len(all))
+	page := &spotify.SimpleAlbumPage{
+		Albums: append([]spotify.SimpleAlbum{}, all[start:end]...),
+	}
+	page.Offset = start
+	page.Total = len(all)
+	return page, nil
+}
+
+func (f *FakeMusicService) GetTracks(ids ...spotify.ID) ([]*spotify.FullTrack, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.call("GetTracks %d", len(ids))
+
+	if len(ids) > 50 {
+		return nil, fmt.Errorf("fake: GetTracks supports up to 50 tracks")
+	}
+
+	tracks := make([]*spotify.FullTrack, 0)
+	for _, id := range ids {
+		t := f.track(id)
+		tracks = append(tracks, &t)
+	}
+	return tracks, nil
+}
+
+func (f *FakeMusicService) Fixture() *FakeFixture {
+	return f.fixture
+}
+
+var _ MusicService = &FakeMusicService{}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zmb3/spotify"
+)
+
+var testEpoch = time.Date(2019, time.June, 1, 10, 0, 0, 0, time.UTC)
+
+func testTrack(id string, artist string, album string, addedAt time.Time) spotify.PlaylistTrack {
+	t := spotify.PlaylistTrack{
+		AddedAt: addedAt.UTC().Format(spotify.TimestampLayout),
+	}
+	t.Track.ID = spotify.ID(id)
+	t.Track.Name = "Track " + id
+	t.Track.URI = spotify.URI("spotify:track:" + id)
+	t.Track.Artists = []spotify.SimpleArtist{{ID: spotify.ID(artist), Name: "Artist " + artist}}
+	t.Track.Album.ID = spotify.ID(album)
+	t.Track.Album.Name = "Album " + album
+	return t
+}
+
+// testTracks makes n tracks spread over a few artists and albums, added a
+// day apart starting at addedAt.
+func testTracks(prefix string, n int, addedAt time.Time) []spotify.PlaylistTrack {
+	tracks := make([]spotify.PlaylistTrack, 0)
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("%s%d", prefix, i)
+		tracks = append(tracks, testTrack(id, fmt.Sprintf("%sartist%d", prefix, i%7), fmt.Sprintf("%salbum%d", prefix, i%11), addedAt.AddDate(0, 0, i)))
+	}
+	return tracks
+}
+
+func testPlaylist(id, name string, tracks []spotify.PlaylistTrack) *FakePlaylist {
+	pl := &FakePlaylist{
+		Tracks: tracks,
+	}
+	pl.Playlist.ID = spotify.ID(id)
+	pl.Playlist.Name = name
+	pl.Playlist.Owner.ID = "tester"
+	pl.Playlist.SnapshotID = "initial-" + id
+	pl.Playlist.Tracks.Total = uint(len(tracks))
+	return pl
+}
+
+func testFixture(playlists ...*FakePlaylist) *FakeFixture {
+	return &FakeFixture{
+		User:      "tester",
+		Playlists: playlists,
+	}
+}
+
+func testTrackIds(tracks []spotify.PlaylistTrack) []string {
+	ids := make([]string, 0)
+	for _, t := range tracks {
+		ids = append(ids, string(t.Track.ID))
+	}
+	return ids
+}
+
+func TestFakeReorderPlaylistTracks(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  spotify.PlaylistReorderOptions
+		expected []string
+		fails    bool
+	}{
+		{"first to end", spotify.PlaylistReorderOptions{RangeStart: 0, RangeLength: 1, InsertBefore: 4}, []string{"t1", "t2", "t3", "t0"}, false},
+		{"last to front", spotify.PlaylistReorderOptions{RangeStart: 3, RangeLength: 1, InsertBefore: 0}, []string{"t3", "t0", "t1", "t2"}, false},
+		{"range forward", spotify.PlaylistReorderOptions{RangeStart: 0, RangeLength: 2, InsertBefore: 3}, []string{"t2", "t0", "t1", "t3"}, false},
+		{"length defaults to one", spotify.PlaylistReorderOptions{RangeStart: 1, InsertBefore: 0}, []string{"t1", "t0", "t2", "t3"}, false},
+		{"out of range", spotify.PlaylistReorderOptions{RangeStart: 3, RangeLength: 2, InsertBefore: 0}, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := NewFakeMusicService(testFixture(testPlaylist("pl", "Playlist", testTracks("t", 4, testEpoch))))
+
+			_, err := f.ReorderPlaylistTracks("pl", test.options)
+			if test.fails {
+				if err == nil {
+					t.Fatalf("expected reorder to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pl, _ := f.playlist("pl")
+			if actual := testTrackIds(pl.Tracks); !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
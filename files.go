@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// WriteFileAtomic writes to a temporary file next to path and renames it
+// into place once it's synced, so readers and crashes never see a partially
+// written file.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+
+	f, err := ioutil.TempFile(dir, "."+base+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	temporary := f.Name()
+	ok := false
+	defer func() {
+		if !ok {
+			f.Close()
+			os.Remove(temporary)
+		}
+	}()
+
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	if err := f.Chmod(perm); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(temporary, path); err != nil {
+		return err
+	}
+
+	ok = true
+
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
+
+type FileLock struct {
+	path string
+	file *os.File
+}
+
+// LockFile takes an exclusive lock on path, creating it if necessary and
+// waiting for any other process holding it.
+func LockFile(path string) (*FileLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening lock: %v", err)
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		log.Printf("waiting for %s, held by another process", path)
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error locking %s: %v", path, err)
+	}
+
+	return &FileLock{
+		path: path,
+		file: f,
+	}, nil
+}
+
+func (l *FileLock) Unlock() error {
+	defer l.file.Close()
+
+	return syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+}
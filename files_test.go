@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zmb3/spotify"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := testTempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state.json")
+
+	for _, data := range []string{"first", "second"} {
+		if err := WriteFileAtomic(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		written, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(written) != data {
+			t.Errorf("expected %s, got %s", data, written)
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected 0600, got %v", info.Mode().Perm())
+	}
+
+	if err := WriteFileAtomic(filepath.Join(dir, "missing", "state.json"), []byte("lost"), 0600); err == nil {
+		t.Errorf("expected an error writing into a missing directory")
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("expected no temporary files left, got %d files", len(files))
+	}
+}
+
+func TestLockFile(t *testing.T) {
+	dir := testTempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, ".lock")
+
+	lock, err := LockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locked := make(chan *FileLock)
+	go func() {
+		second, err := LockFile(path)
+		if err != nil {
+			t.Error(err)
+		}
+		locked <- second
+	}()
+
+	select {
+	case <-locked:
+		t.Fatalf("expected the second lock to wait")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case second := <-locked:
+		if second != nil {
+			second.Unlock()
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected the second lock once the first was released")
+	}
+}
+
+func TestCacheDiscardsCorrupted(t *testing.T) {
+	dir := testTempDir(t)
+	defer os.RemoveAll(dir)
+
+	options := testOptions(dir)
+	fake := NewFakeMusicService(testLibrary())
+
+	cacher, closeCache, err := OpenSpotifyCacher(options, fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer closeCache()
+
+	for _, key := range []string{"playlist-jan", "track-jan1"} {
+		if err := cacher.put(key, []byte(`{"truncated`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tracks, err := cacher.GetPlaylistTracks(options.User, "jan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 10 || countCalls(fake, "GetPlaylistTracksOpt jan") != 1 {
+		t.Errorf("expected the playlist fetched again, got %d tracks and %v", len(tracks), fake.Calls)
+	}
+
+	full, err := cacher.GetTracks([]spotify.ID{"jan1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(full) != 1 || full[0].ID != "jan1" || countCalls(fake, "GetTracks") != 1 {
+		t.Errorf("expected the track fetched again, got %v and %v", full, fake.Calls)
+	}
+
+	// Both were written again in place of the corrupted entries.
+	for _, key := range []string{"playlist-jan", "track-jan1"} {
+		data, err := cacher.storage.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) == 0 || string(data) == `{"truncated` {
+			t.Errorf("expected %s replaced, got %s", key, data)
+		}
+	}
+}
@@ -5,66 +5,60 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
+	"time"
 
 	"encoding/json"
+
+	"github.com/zmb3/spotify"
 )
 
 type Options struct {
-	Dry     bool
-	Serve   bool
-	Refresh bool
-	Self    string
-	User    string
-	Name    string
-	Size    int
+	Dry         bool
+	Serve       bool
+	Refresh     bool
+	Self        string
+	User        string
+	Name        string
+	Size        int
+	Sampler     SamplerOptions
+	Constraints Constraints
+	Cooldown    time.Duration
+	Seed        int64
+	Now         time.Time
+	Sources     string
+	Recipes     string
+	Keep        int
+	Plan        string
+	PlanFile    string
+	Fake        string
+	Mock        string
+	MockFail    string
+	Retry       RetryPolicy
+	Concurrency int
+	Cache       string
+	CacheTTL    string
+	CacheMaxMB  int
+	MigrateTo   string
+	Offline     bool
+	State       StateDirectory
+	Auth        AuthOptions
 }
 
-func readPlaylistSummaries(file string) (summaries *PlaylistSummaries, err error) {
-	if _, err := os.Stat(file); !os.IsNotExist(err) {
-		summaries, err = LoadSummaries(file)
-		if err != nil {
-			return nil, err
-		}
-
-		return summaries, nil
+func generateSummary(path string, cacher *SpotifyCacher, user string, playlists *PlaylistSet) error {
+	summaries := &PlaylistSummaries{
+		Playlists: make([]*PlaylistSummary, 0),
 	}
 
-	return nil, nil
-}
-
-func generateSummary(cacher *SpotifyCacher, user string, playlists *PlaylistSet, dry bool) error {
-	old, err := readPlaylistSummaries(".cache/playlists.json")
+	all, err := cacher.GetPlaylistsTracks(user, playlists.Playlists)
 	if err != nil {
 		return err
 	}
 
-	summaries := &PlaylistSummaries{
-		Playlists: make([]*PlaylistSummary, 0),
-	}
-
 	for _, pl := range playlists.Playlists {
-		if old != nil {
-			for _, oldSummary := range old.Playlists {
-				if oldSummary.ID == pl.ID {
-					if oldSummary.SnapshotID != pl.SnapshotID {
-						if !dry {
-							cacher.Invalidate(pl.ID)
-							break
-						}
-					} else {
-						break
-					}
-				}
-			}
-		}
-
-		tracks, err := cacher.GetPlaylistTracks(user, pl.ID)
-		if err != nil {
-			return err
-		}
+		tracks := all[pl.ID]
 
 		summary, err := Summarize(pl, tracks)
 		if err != nil {
@@ -76,12 +70,14 @@ func generateSummary(cacher *SpotifyCacher, user string, playlists *PlaylistSet,
 		summaries.Playlists = append(summaries.Playlists, summary)
 	}
 
+	summaries.SortChronologically()
+
 	json, err := json.Marshal(summaries)
 	if err != nil {
 		return fmt.Errorf("error saving playlists: %v", err)
 	}
 
-	err = ioutil.WriteFile("playlists.json", json, 0644)
+	err = WriteFileAtomic(path, json, 0644)
 	if err != nil {
 		return fmt.Errorf("error saving playlists: %v", err)
 	}
@@ -89,85 +85,521 @@ func generateSummary(cacher *SpotifyCacher, user string, playlists *PlaylistSet,
 	return nil
 }
 
-func refreshSpotify(options *Options) error {
-	log.Printf("getting playlists for %v, creating playlist for %v", options.User, options.Self)
+type generator struct {
+	state     *StateDirectory
+	clients   map[string]MusicService
+	cacher    *SpotifyCacher
+	playlists map[string]*PlaylistSet
+	offline   bool
+	plans     []*Plan
+}
+
+func (g *generator) getUserPlaylists(user string) (*PlaylistSet, error) {
+	if playlists, ok := g.playlists[user]; ok {
+		return playlists, nil
+	}
+
+	if g.offline {
+		playlists, err := g.cacher.GetPlaylists(user)
+		if err != nil {
+			return nil, err
+		}
+
+		g.playlists[user] = playlists
+
+		return playlists, generateSummary(g.state.Summaries(), g.cacher, user, playlists)
+	}
 
-	logFile, err := os.OpenFile("generator.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	playlists, sync, err := g.cacher.Sync(user)
 	if err != nil {
-		return fmt.Errorf("error opening file: %v", err)
+		return nil, err
 	}
-	defer logFile.Close()
-	buffer := new(bytes.Buffer)
-	multi := io.MultiWriter(logFile, buffer, os.Stdout)
-	log.SetOutput(multi)
 
-	spotifyClient, _ := AuthenticateSpotify()
-	cacher := NewSpotifyCacher(spotifyClient, options.Refresh)
+	sync.Log()
 
-	pl, err := GetPlaylist(spotifyClient, options.Self, options.Name)
+	err = generateSummary(g.state.Summaries(), g.cacher, user, playlists)
+	if err != nil {
+		return nil, err
+	}
+
+	g.playlists[user] = playlists
+
+	return playlists, nil
+}
+
+// Playlists are written with the credentials of their -self account, while
+// everything read goes through the cacher.
+func (g *generator) client(options *Options) (MusicService, error) {
+	if spotifyClient, ok := g.clients[options.Self]; ok {
+		return spotifyClient, nil
+	}
+
+	spotifyClient, err := connect(options)
+	if err != nil {
+		return nil, err
+	}
+
+	g.clients[options.Self] = spotifyClient
+
+	return spotifyClient, nil
+}
+
+func (g *generator) generate(options *Options) error {
+	log.Printf("getting playlists for %v, creating playlist '%s' for %v", options.User, options.Name, options.Self)
+
+	spotifyClient, err := g.client(options)
+	if err != nil {
+		return err
+	}
+
+	pl, err := g.getTargetPlaylist(spotifyClient, options)
 	if err != nil {
 		return fmt.Errorf("error opening file: %v", err)
 	}
 
-	cacher.Invalidate(pl.ID)
+	if !options.Dry {
+		recovered, err := RecoverPlaylistTransaction(spotifyClient, g.state.Transaction(pl.ID), pl.ID)
+		if err != nil {
+			return err
+		}
+		if recovered {
+			log.Printf("restored %v from unfinished update", pl.ID)
+		}
+	}
+
+	existingTracks := make([]spotify.PlaylistTrack, 0)
+	if len(pl.ID) > 0 {
+		if !g.offline {
+			g.cacher.Invalidate(pl.ID)
+		}
 
-	existingTracks, err := cacher.GetPlaylistTracks(options.User, pl.ID)
+		existingTracks, err = g.cacher.GetPlaylistTracks(options.User, pl.ID)
+		if err != nil {
+			return fmt.Errorf("%v", err)
+		}
+	}
+
+	log.Printf("have %v (%v tracks)", pl, len(existingTracks))
+
+	playlists, err := g.getUserPlaylists(options.User)
 	if err != nil {
 		return fmt.Errorf("%v", err)
 	}
 
-	log.Printf("have %v (%v tracks)", pl, len(existingTracks))
+	seed := options.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	// Everything relative to the time of the run uses this, so with the seed
+	// it reproduces a run.
+	now := options.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	log.Printf("seed: %d now: %s", seed, now.Format(time.RFC3339))
 
-	cacher.InvalidateUser(options.User)
+	rng := rand.New(rand.NewSource(seed))
 
-	playlists, err := cacher.GetPlaylists(options.User)
+	sampler, err := NewSampler(&options.Sampler, now, rng)
 	if err != nil {
-		return fmt.Errorf("%v", err)
+		return err
 	}
 
-	allTracks := NewEmptyTracksSet()
+	selector, err := ParseSelector(options.Sources)
+	if err != nil {
+		return err
+	}
 
-	err = generateSummary(cacher, options.User, playlists, options.Dry)
+	selector.Now = now
+
+	sources, err := selector.Select(playlists, func(pl Playlist) ([]spotify.PlaylistTrack, error) {
+		return g.cacher.GetPlaylistTracks(options.User, pl.ID)
+	})
 	if err != nil {
-		return fmt.Errorf("%v", err)
+		return err
+	}
+
+	plan := &Plan{
+		Name:       options.Name,
+		PlaylistID: pl.ID,
+		Seed:       seed,
+		Now:        now,
+		Sampler:    options.Sampler.Name,
+		Selector:   options.Sources,
+		Sources:    make([]*PlanSource, 0),
+		Kept:       make([]*PlanTrack, 0),
+		Selected:   make([]*PlanTrack, 0),
+		Remove:     make([]*PlanTrack, 0),
 	}
 
-	for _, pl := range playlists.Monthly().Playlists {
-		tracks, err := cacher.GetPlaylistTracks(options.User, pl.ID)
+	pool := NewCandidatePool()
+
+	for _, pl := range sources.Playlists {
+		tracks, err := g.cacher.GetPlaylistTracks(options.User, pl.ID)
 		if err != nil {
 			return fmt.Errorf("%v", err)
 		}
 
-		log.Printf("monthly: %v (%d tracks)", pl.Name, len(tracks))
+		log.Printf("source: %v (%d tracks)", pl.Name, len(tracks))
 
-		allTracks = allTracks.MergeInPlace(tracks)
+		pool.Add(pl, tracks)
+		plan.AddSource(pl, tracks)
 	}
 
-	log.Printf("total tracks: %v", len(allTracks.Ids))
+	log.Printf("total tracks: %v", pool.Len())
+
+	history, err := LoadHistory(g.state.History())
+	if err != nil {
+		return err
+	}
 
 	existing := NewTracksSetFromPlaylist(existingTracks)
-	sampling := allTracks.Remove(existing)
+	sampling := pool.Remove(existing)
+
+	plan.Pool = pool.Len()
+	plan.Existing = pool.Len() - sampling.Len()
 
-	log.Printf("sampling tracks: %v", len(sampling.Ids))
+	if options.Cooldown > 0 {
+		served := history.ServedBetween(pl.ID, now.Add(-options.Cooldown), now)
 
-	selected := sampling.Sample(options.Size)
+		log.Printf("cooling down: %v (served in the last %s)", len(served.Ids), formatDays(options.Cooldown))
+
+		sampling = sampling.Remove(served)
+
+		plan.CooledDown = pool.Len() - plan.Existing - sampling.Len()
+	}
+
+	plan.Eligible = sampling.Len()
+
+	log.Printf("sampling tracks: %v (%s)", sampling.Len(), options.Sampler.Name)
+
+	ordered, err := sampler.Sample(sampling, sampling.Len())
+	if err != nil {
+		return fmt.Errorf("%v", err)
+	}
+
+	kept := keepTracks(existing, options.Keep, rng)
+
+	selected := options.Constraints.Apply(sampling, ordered, keptCandidates(existingTracks, kept), options.Size-len(kept.Ids))
+
+	update := NewPlaylistUpdate(existing.ToArray())
+	for _, id := range kept.ToArray() {
+		update.AddTrack(id)
+	}
+	for _, id := range selected.ToArray() {
+		update.AddTrack(id)
+	}
+
+	log.Printf("keeping %v, removing %v, adding %v, moving %v", len(kept.Ids), len(update.GetIdsToRemove().Ids), len(update.GetIdsToAdd().Ids), len(update.GetMoves()))
+
+	for _, id := range selected.ToArray() {
+		plan.AddSelected(sampling.Get(id), options.Cooldown)
+	}
+	plan.AddExisting(existingTracks, kept, update)
 
 	if !options.Dry {
-		log.Printf("removing old tracks: %v", len(existing.Ids))
+		tx := NewPlaylistTransaction(g.state.Transaction(pl.ID), pl.ID, existing.ToArray(), update)
 
-		err = RemoveTracksSetFromPlaylist(spotifyClient, pl.ID, existing)
+		err = tx.Commit(spotifyClient)
 		if err != nil {
 			return fmt.Errorf("%v", err)
 		}
 
-		log.Printf("adding new tracks: %v", len(selected.Ids))
+		history.Record(pl.ID, pl.Name, now, seed, selected)
 
-		err = AddTracksSetToPlaylist(spotifyClient, pl.ID, selected)
+		err = history.Save(g.state.History())
 		if err != nil {
-			return fmt.Errorf("%v", err)
+			return err
 		}
 	} else {
 		log.Printf("dry run!")
+
+		g.plans = append(g.plans, plan)
+	}
+
+	return nil
+}
+
+func (g *generator) getTargetPlaylist(spotifyClient MusicService, options *Options) (*spotify.SimplePlaylist, error) {
+	if g.offline {
+		return GetCachedPlaylist(g.cacher, options.Self, options.Name)
+	}
+
+	// Dry runs plan against an empty playlist rather than creating it.
+	if options.Dry {
+		pl, err := GetPlaylistByTitle(spotifyClient, options.Self, options.Name)
+		if err != nil {
+			return nil, err
+		}
+		if pl == nil {
+			log.Printf("'%s' doesn't exist yet and would be created", options.Name)
+			return &spotify.SimplePlaylist{Name: options.Name}, nil
+		}
+		return pl, nil
+	}
+
+	return GetPlaylist(spotifyClient, options.Self, options.Name)
+}
+
+func keepTracks(existing *TracksSet, number int, rng *rand.Rand) *TracksSet {
+	kept := NewEmptyTracksSet()
+
+	ids := make([]spotify.ID, 0)
+	for _, id := range existing.ToArray() {
+		if len(id) > 0 && !kept.Contains(id) {
+			kept.Add(id)
+			ids = append(ids, id)
+		}
+	}
+
+	if number >= len(ids) {
+		return kept
+	}
+
+	keeping := make(map[spotify.ID]bool)
+	for _, i := range rng.Perm(len(ids))[:number] {
+		keeping[ids[i]] = true
+	}
+
+	kept = NewEmptyTracksSet()
+	for _, id := range ids {
+		if keeping[id] {
+			kept.Add(id)
+		}
+	}
+
+	return kept
+}
+
+// keptCandidates are the kept tracks in the order they'll be in the playlist.
+func keptCandidates(existing []spotify.PlaylistTrack, kept *TracksSet) []*Candidate {
+	candidates := make([]*Candidate, 0)
+	adding := NewEmptyTracksSet()
+	for _, t := range existing {
+		if kept.Contains(t.Track.ID) && !adding.Contains(t.Track.ID) {
+			adding.Add(t.Track.ID)
+			candidates = append(candidates, &Candidate{
+				ID:    t.Track.ID,
+				Track: t,
+			})
+		}
+	}
+	return candidates
+}
+
+func connect(options *Options) (MusicService, error) {
+	if options.Offline {
+		log.Printf("offline, using only cached playlists and tracks")
+		return &OfflineMusicService{}, nil
+	}
+
+	if options.Fake != "" {
+		log.Printf("using fake music service from %s", options.Fake)
+		return LoadFakeMusicService(options.Fake)
+	}
+
+	if options.Mock != "" {
+		return connectMock(options)
+	}
+
+	spotifyClient, err := AuthenticateSpotify(options.State.Tokens(), options.Self, &options.Auth, &options.Retry)
+	if err != nil {
+		return nil, err
+	}
+
+	return spotifyClient, nil
+}
+
+func connectMock(options *Options) (MusicService, error) {
+	fake, err := LoadFakeMusicService(options.Mock)
+	if err != nil {
+		return nil, err
+	}
+
+	failures, err := ParseMockFailures(options.MockFail)
+	if err != nil {
+		return nil, err
+	}
+
+	mock := NewMockSpotifyServer(fake)
+	mock.Fail(failures...)
+
+	log.Printf("using mock spotify api on %s from %s", mock.URL(), options.Mock)
+
+	spotifyClient, err := mock.Client(&options.Retry)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := spotifyClient.CurrentUser()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("spotify: you are logged in as", user.ID)
+
+	return spotifyClient, nil
+}
+
+func writePlan(plans *Plans, options *Options) error {
+	if options.PlanFile == "" {
+		return plans.Write(os.Stdout, options.Plan)
+	}
+
+	f, err := os.Create(options.PlanFile)
+	if err != nil {
+		return fmt.Errorf("error writing plan: %v", err)
+	}
+
+	defer f.Close()
+
+	return plans.Write(f, options.Plan)
+}
+
+func refreshSpotify(options *Options) error {
+	logFile, err := os.OpenFile(options.State.Log(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return fmt.Errorf("error opening file: %v", err)
+	}
+	defer logFile.Close()
+	buffer := new(bytes.Buffer)
+	multi := io.MultiWriter(logFile, buffer, os.Stderr)
+	log.SetOutput(multi)
+	defer log.SetOutput(os.Stderr)
+
+	all := []*Options{options}
+	if options.Recipes != "" {
+		recipes, err := LoadRecipes(options.Recipes)
+		if err != nil {
+			return err
+		}
+
+		all, err = recipes.Options(options)
+		if err != nil {
+			return err
+		}
+
+		if len(all) == 0 {
+			return fmt.Errorf("no recipes in %s", options.Recipes)
+		}
+
+		log.Printf("recipes: %d", len(all))
+	}
+
+	spotifyClient, err := connect(all[0])
+	if err != nil {
+		return err
+	}
+
+	cacher, closeCache, err := OpenSpotifyCacher(options, spotifyClient)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := closeCache(); err != nil {
+			log.Printf("%v", err)
+		}
+	}()
+
+	g := &generator{
+		state:     &options.State,
+		clients:   map[string]MusicService{all[0].Self: spotifyClient},
+		cacher:    cacher,
+		playlists: make(map[string]*PlaylistSet),
+		offline:   options.Offline,
+		plans:     make([]*Plan, 0),
+	}
+
+	defer func() {
+		log.Printf("spotify: %v", options.Retry.Stats)
+	}()
+
+	return g.run(all, options)
+}
+
+// run generates every recipe, writing a single plan covering all of them for
+// dry runs.
+func (g *generator) run(all []*Options, options *Options) error {
+	for _, recipe := range all {
+		err := g.generate(recipe)
+		if err != nil {
+			return fmt.Errorf("error generating '%s': %v", recipe.Name, err)
+		}
+	}
+
+	if options.Dry {
+		return writePlan(&Plans{Plans: g.plans}, options)
+	}
+
+	return nil
+}
+
+func migrateCache(options *Options) error {
+	fromLock, err := LockStorage(options.Cache)
+	if err != nil {
+		return err
+	}
+
+	defer fromLock.Unlock()
+
+	from, err := OpenStorage(options.Cache)
+	if err != nil {
+		return err
+	}
+
+	defer from.Close()
+
+	toLock, err := LockStorage(options.MigrateTo)
+	if err != nil {
+		return err
+	}
+
+	defer toLock.Unlock()
+
+	to, err := OpenStorage(options.MigrateTo)
+	if err != nil {
+		return err
+	}
+
+	defer to.Close()
+
+	migrated, err := MigrateStorage(from, to)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("migrated %d cache entries from %s to %s", migrated, options.Cache, options.MigrateTo)
+
+	return nil
+}
+
+func cacheCommand(options *Options, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: cache gc|stats")
+	}
+
+	cacher, closeCache, err := OpenSpotifyCacher(options, nil)
+	if err != nil {
+		return err
+	}
+
+	defer closeCache()
+
+	switch args[0] {
+	case "gc":
+		removed, err := cacher.GarbageCollect()
+		if err != nil {
+			return err
+		}
+
+		log.Printf("cache: removed %d entries", removed)
+	case "stats":
+		WriteCacheStats(os.Stdout, cacher.Stats())
+	default:
+		return fmt.Errorf("unknown cache command: %v", args[0])
 	}
 
 	return nil
@@ -179,19 +611,99 @@ func main() {
 	flag.BoolVar(&options.Dry, "dry", false, "dry")
 	flag.BoolVar(&options.Serve, "serve", false, "serve")
 	flag.BoolVar(&options.Refresh, "refresh", false, "refresh")
-	flag.StringVar(&options.Self, "self", "jlewalle", "self")
-	flag.StringVar(&options.User, "user", "jlewalle", "user")
+	flag.StringVar(&options.Self, "self", "jlewalle", "spotify account whose credentials are used and who owns the generated playlist")
+	flag.StringVar(&options.User, "user", "jlewalle", "spotify user whose playlists are sampled")
 	flag.StringVar(&options.Name, "name", "rediscover weekly", "name")
 	flag.IntVar(&options.Size, "size", 30, "size")
+	flag.StringVar(&options.Sampler.Name, "sampler", "uniform", "sampler (uniform, weighted, recency, stratified, diverse)")
+	flag.StringVar(&options.Sampler.Recency, "recency", "old", "recency sampler favours (old, recent)")
+	flag.StringVar(&options.Sampler.Decay, "decay", "exponential", "recency decay curve (exponential, linear)")
+	flag.DurationVar(&options.Sampler.HalfLife, "half-life", 26*7*24*time.Hour, "recency half life")
+	flag.StringVar(&options.Sampler.Stratify, "stratify", "equal", "stratified allocation across source playlists (equal, proportional)")
+	flag.IntVar(&options.Sampler.YearCap, "year-cap", 0, "stratified maximum tracks per year, 0 for no cap")
+	flag.IntVar(&options.Constraints.MaxPerArtist, "max-per-artist", 0, "maximum tracks per artist, 0 for no limit")
+	flag.IntVar(&options.Constraints.MaxPerAlbum, "max-per-album", 0, "maximum tracks per album, 0 for no limit")
+	flag.IntVar(&options.Constraints.MinArtistGap, "artist-gap", 0, "minimum tracks between two by the same artist")
+	flag.StringVar(&options.Sources, "sources", "monthly", "source playlist selector, e.g. monthly,glob:summer *,exclude-id:ID,owned,min-tracks:10,from:2017,to:2019")
+	flag.StringVar(&options.Recipes, "recipes", "", "recipes file describing playlists to generate")
+	flag.IntVar(&options.Keep, "keep", 0, "number of tracks to keep from the current playlist")
+	flag.StringVar(&options.Plan, "plan", "text", "dry run plan format (text, json)")
+	flag.StringVar(&options.PlanFile, "plan-file", "", "write the dry run plan here instead of stdout")
+	flag.StringVar(&options.Fake, "fake", "", "use a fake music service backed by this fixture file")
+	flag.StringVar(&options.Mock, "mock", "", "run against a local mock of the spotify api backed by this fixture file")
+	flag.StringVar(&options.MockFail, "mock-fail", "", "mock api failures as status:count:path, e.g. 429:2:/tracks,503:1:")
+	flag.BoolVar(&options.Offline, "offline", false, "never talk to spotify, build plans and summaries from the cache only, expired or not, implies -dry")
+	flag.StringVar(&options.State.Path, "state", DefaultStateDirectory(), "directory for the cache, tokens, history and summaries, also set by $"+StateEnvironmentVariable)
+	flag.StringVar(&options.Cache, "cache", "", "cache storage, dir:PATH for a directory of json files or bolt:PATH for a single database file, defaults to dir:STATE/cache")
+	flag.StringVar(&options.CacheTTL, "cache-ttl", "", "cache expiry by kind overriding the defaults, e.g. track=720h,album=0,artist-albums=168h")
+	flag.IntVar(&options.CacheMaxMB, "cache-max-mb", 0, "evict least recently used cache entries above this size, 0 for no limit")
+	flag.StringVar(&options.MigrateTo, "migrate-cache", "", "copy every entry from the -cache storage into this one and exit, e.g. bolt:cache.db")
+	flag.StringVar(&options.Auth.Listen, "auth-listen", ":9090", "address to listen on for spotify's authorization redirect, the address the browser is redirected to can be pasted instead, empty to only paste it")
+	flag.StringVar(&options.Auth.Redirect, "auth-redirect", spotifyRedirectUrl, "redirect url registered with spotify, which must reach -auth-listen or be pasted back")
+	flag.IntVar(&options.Concurrency, "concurrency", 4, "maximum parallel spotify requests when fetching playlists, albums and tracks")
+	flag.IntVar(&options.Retry.MaxAttempts, "retry-attempts", 5, "attempts per spotify request before giving up, 1 to disable retries")
+	flag.DurationVar(&options.Retry.BaseDelay, "retry-delay", 1*time.Second, "initial delay between retries, doubled on each attempt")
+	flag.DurationVar(&options.Retry.MaxDelay, "retry-max-delay", 30*time.Second, "maximum delay between retries, unless spotify asks for longer")
+	flag.DurationVar(&options.Retry.Budget, "retry-budget", 2*time.Minute, "maximum time spent retrying a single spotify request, 0 for no limit")
+	flag.Int64Var(&options.Seed, "seed", 0, "random seed, 0 to pick one")
+	now := flag.String("now", "", "time to generate as of, RFC3339, with -seed reproduces an earlier run from its history")
+	flag.DurationVar(&options.Cooldown, "cooldown", 12*7*24*time.Hour, "skip tracks served to this playlist within this window, 0 to disable")
 
 	flag.Parse()
 
-	if options.Serve {
+	if *now != "" {
+		parsed, err := time.Parse(time.RFC3339, *now)
+		if err != nil {
+			log.Fatalf("invalid -now: %v", err)
+		}
+		options.Now = parsed
+	}
+
+	if options.Offline {
+		if options.Refresh {
+			log.Fatalf("-offline and -refresh can't be used together")
+		}
+		options.Dry = true
+	}
+
+	options.Retry.Stats = &RetryStats{}
+
+	if err := options.State.Create(); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	if options.Cache == "" {
+		options.Cache = options.State.Cache()
+	}
+
+	if flag.Arg(0) == "state" {
+		err := stateCommand(options, flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+	} else if flag.Arg(0) == "cache" {
+		err := cacheCommand(options, flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+	} else if flag.Arg(0) == "accounts" {
+		err := accountsCommand(options, flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+	} else if options.MigrateTo != "" {
+		err := migrateCache(options)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+	} else if options.Serve {
 		err := Serve(options)
 		if err != nil {
 			log.Fatalf("%v", err)
 		}
 	} else {
+		options.State.CheckLegacy(".")
+
 		err := refreshSpotify(options)
 		if err != nil {
 			log.Fatalf("%v", err)
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zmb3/spotify"
+)
+
+func testLibrary() *FakeFixture {
+	return testFixture(
+		testPlaylist("jan", "January 2019", testTracks("jan", 10, testEpoch.AddDate(0, -5, 0))),
+		testPlaylist("feb", "February 2019", testTracks("feb", 10, testEpoch.AddDate(0, -4, 0))),
+		testPlaylist("mar", "March 2019", testTracks("mar", 10, testEpoch.AddDate(0, -3, 0))),
+		testPlaylist("jams", "Summer Jams", testTracks("jams", 10, testEpoch)),
+		testPlaylist("target", "target", testTracks("jan", 3, testEpoch.AddDate(0, -5, 0))),
+	)
+}
+
+func testOptions(dir string) *Options {
+	options := &Options{
+		Self:        "tester",
+		User:        "tester",
+		Name:        "target",
+		Size:        10,
+		Sources:     "monthly",
+		Plan:        "json",
+		Seed:        7,
+		Concurrency: 1,
+		Sampler: SamplerOptions{
+			Name: "uniform",
+		},
+	}
+	options.State.Path = dir
+	options.Cache = options.State.Cache()
+	return options
+}
+
+func testGenerate(t *testing.T, fixture *FakeFixture, all ...*Options) *FakeMusicService {
+	return testGenerateWith(t, NewFakeMusicService(fixture), all...)
+}
+
+func testGenerateWith(t *testing.T, fake *FakeMusicService, all ...*Options) *FakeMusicService {
+	cacher, closeCache, err := OpenSpotifyCacher(all[0], fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeCache()
+
+	g := &generator{
+		state:     &all[0].State,
+		clients:   map[string]MusicService{all[0].Self: fake},
+		cacher:    cacher,
+		playlists: make(map[string]*PlaylistSet),
+		plans:     make([]*Plan, 0),
+	}
+
+	if err := g.run(all, all[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	return fake
+}
+
+func testTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "playlist-generator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func mutatingCalls(f *FakeMusicService) []string {
+	calls := make([]string, 0)
+	for _, call := range f.Calls {
+		for _, prefix := range []string{"Add", "Remove", "Reorder", "Replace", "Create"} {
+			if strings.HasPrefix(call, prefix) {
+				calls = append(calls, call)
+			}
+		}
+	}
+	return calls
+}
+
+func playlistIds(f *FakeMusicService, id spotify.ID) []string {
+	pl, err := f.playlist(id)
+	if err != nil {
+		return nil
+	}
+	return testTrackIds(pl.Tracks)
+}
+
+func countPrefixed(ids []string, prefixes ...string) int {
+	n := 0
+	for _, id := range ids {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(id, prefix) {
+				n += 1
+				break
+			}
+		}
+	}
+	return n
+}
+
+func TestGenerate(t *testing.T) {
+	before := []string{"jan0", "jan1", "jan2"}
+
+	tests := []struct {
+		name     string
+		options  func(o *Options)
+		calls    []string
+		kept     int
+		expected int
+	}{
+		{
+			name:     "replaces the target",
+			options:  func(o *Options) {},
+			calls:    []string{"RemoveTracksFromPlaylist target 3", "AddTracksToPlaylist target 10"},
+			kept:     0,
+			expected: 10,
+		},
+		{
+			name:     "dry run changes nothing",
+			options:  func(o *Options) { o.Dry = true },
+			calls:    []string{},
+			kept:     3,
+			expected: 3,
+		},
+		{
+			name:     "keeps some of the target",
+			options:  func(o *Options) { o.Keep = 2 },
+			calls:    []string{"RemoveTracksFromPlaylist target 1", "AddTracksToPlaylist target 8"},
+			kept:     2,
+			expected: 10,
+		},
+		{
+			name:     "keeping everything only tops up",
+			options:  func(o *Options) { o.Keep = 5 },
+			calls:    []string{"AddTracksToPlaylist target 7"},
+			kept:     3,
+			expected: 10,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testTempDir(t)
+			defer os.RemoveAll(dir)
+
+			options := testOptions(dir)
+			options.PlanFile = filepath.Join(dir, "plan.json")
+			test.options(options)
+
+			fake := testGenerate(t, testLibrary(), options)
+
+			if calls := mutatingCalls(fake); !reflect.DeepEqual(calls, test.calls) {
+				t.Errorf("expected calls %v, got %v", test.calls, calls)
+			}
+
+			after := playlistIds(fake, "target")
+			if len(after) != test.expected {
+				t.Errorf("expected %d tracks, got %v", test.expected, after)
+			}
+			if kept := countPrefixed(after, before...); kept != test.kept {
+				t.Errorf("expected to keep %d tracks, kept %d of %v", test.kept, kept, after)
+			}
+			if jams := countPrefixed(after, "jams"); jams != 0 {
+				t.Errorf("expected only monthly sources, got %v", after)
+			}
+
+			if _, err := os.Stat(options.State.Transaction("target")); !os.IsNotExist(err) {
+				t.Errorf("expected the transaction journal to be removed: %v", err)
+			}
+
+			_, err := os.Stat(options.PlanFile)
+			if options.Dry != (err == nil) {
+				t.Errorf("expected a plan only for dry runs: %v", err)
+			}
+		})
+	}
+}
+
+func TestGenerateDryRunPlan(t *testing.T) {
+	dir := testTempDir(t)
+	defer os.RemoveAll(dir)
+
+	options := testOptions(dir)
+	options.Dry = true
+	options.PlanFile = filepath.Join(dir, "plan.json")
+
+	fake := testGenerate(t, testLibrary(), options)
+
+	if calls := mutatingCalls(fake); len(calls) != 0 {
+		t.Errorf("expected a dry run to change nothing, got %v", calls)
+	}
+
+	plans := readPlans(t, options.PlanFile)
+	if len(plans.Plans) != 1 {
+		t.Fatalf("expected one plan, got %d", len(plans.Plans))
+	}
+
+	plan := plans.Plans[0]
+	if plan.Seed != options.Seed || len(plan.Sources) != 3 || len(plan.Selected) != 10 || len(plan.Remove) != 3 || len(plan.Add) != 10 {
+		t.Errorf("unexpected plan: seed %d, %d sources, %d selected, %d removed, %d added", plan.Seed, len(plan.Sources), len(plan.Selected), len(plan.Remove), len(plan.Add))
+	}
+}
+
+func TestGenerateRecipes(t *testing.T) {
+	dir := testTempDir(t)
+	defer os.RemoveAll(dir)
+
+	recipes := &Recipes{
+		Recipes: []*Recipe{
+			{Name: "target", Size: testInt(5)},
+			{Name: "jams mix", Size: testInt(4), Sources: "name:^Summer"},
+			{Name: "fresh", Size: testInt(6), Sources: "name:^(January|February)"},
+		},
+	}
+
+	all, err := recipes.Options(testOptions(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := testGenerate(t, testLibrary(), all...)
+
+	expected := []string{
+		"RemoveTracksFromPlaylist target 3",
+		"AddTracksToPlaylist target 5",
+		"CreatePlaylistForUser tester jams mix",
+		"AddTracksToPlaylist fake5 4",
+		"CreatePlaylistForUser tester fresh",
+		"AddTracksToPlaylist fake6 6",
+	}
+	if calls := mutatingCalls(fake); !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected calls %v, got %v", expected, calls)
+	}
+
+	if after := playlistIds(fake, "target"); len(after) != 5 || countPrefixed(after, "jams") != 0 {
+		t.Errorf("unexpected target: %v", after)
+	}
+	if after := playlistIds(fake, "fake5"); len(after) != 4 || countPrefixed(after, "jams") != 4 {
+		t.Errorf("unexpected jams mix: %v", after)
+	}
+	if after := playlistIds(fake, "fake6"); len(after) != 6 || countPrefixed(after, "jan", "feb") != 6 {
+		t.Errorf("unexpected fresh: %v", after)
+	}
+
+	history, err := LoadHistory(all[0].State.History())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []spotify.ID{"target", "fake5", "fake6"} {
+		if len(history.ServedBetween(id, testEpoch, time.Now().Add(time.Minute)).Ids) == 0 {
+			t.Errorf("expected history for %v", id)
+		}
+	}
+}
+
+func readPlans(t *testing.T, path string) *Plans {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plans := &Plans{}
+	if err := json.Unmarshal(data, plans); err != nil {
+		t.Fatal(err)
+	}
+
+	return plans
+}
+
+// testDryRunPlan plans a run in the options' state directory, or a new one
+// if they don't have one.
+func testDryRunPlan(t *testing.T, options *Options) *Plan {
+	dir := testTempDir(t)
+	defer os.RemoveAll(dir)
+
+	dry := *options
+	if dry.State.Path == "" {
+		dry.State.Path = dir
+		dry.Cache = dry.State.Cache()
+	}
+	dry.Dry = true
+	dry.PlanFile = filepath.Join(dir, "plan.json")
+
+	fake := testGenerate(t, testLibrary(), &dry)
+
+	if calls := mutatingCalls(fake); len(calls) != 0 {
+		t.Errorf("expected a dry run to change nothing, got %v", calls)
+	}
+
+	plans := readPlans(t, dry.PlanFile)
+	if len(plans.Plans) != 1 {
+		t.Fatalf("expected one plan, got %d", len(plans.Plans))
+	}
+
+	return plans.Plans[0]
+}
+
+func selectedIds(plan *Plan) []spotify.ID {
+	ids := make([]spotify.ID, 0)
+	for _, t := range plan.Selected {
+		ids = append(ids, t.ID)
+	}
+	return ids
+}
+
+func TestGenerateGolden(t *testing.T) {
+	options := testOptions("")
+	options.Sampler = SamplerOptions{Name: "recency", Recency: "recent", Decay: "exponential", HalfLife: 30 * 24 * time.Hour}
+	options.Now = testEpoch
+
+	// Changing the sampler, constraints or how the pool is built changes this.
+	expected := []spotify.ID{"mar3", "mar0", "mar1", "mar5", "feb6", "mar8", "jan3", "jan6", "feb9", "mar9"}
+
+	for i := 0; i < 3; i++ {
+		if actual := selectedIds(testDryRunPlan(t, options)); !reflect.DeepEqual(actual, expected) {
+			t.Fatalf("expected %v, got %v", expected, actual)
+		}
+	}
+}
+
+func TestGenerateReproducesHistory(t *testing.T) {
+	dir := testTempDir(t)
+	defer os.RemoveAll(dir)
+
+	options := testOptions(dir)
+	options.Seed = 0
+	options.Now = testEpoch
+	options.Cooldown = 30 * 24 * time.Hour
+	options.Sampler = SamplerOptions{Name: "recency", Recency: "old", Decay: "linear", HalfLife: 60 * 24 * time.Hour}
+
+	testGenerate(t, testLibrary(), options)
+
+	history, err := LoadHistory(options.State.History())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(history.Runs) != 1 {
+		t.Fatalf("expected one run, got %d", len(history.Runs))
+	}
+
+	run := history.Runs[0]
+	if run.Seed == 0 || !run.At.Equal(testEpoch) {
+		t.Fatalf("expected the seed and time of the run, got %d %v", run.Seed, run.At)
+	}
+
+	again := *options
+	again.Seed = run.Seed
+	again.Now = run.At
+
+	if actual := selectedIds(testDryRunPlan(t, &again)); !reflect.DeepEqual(actual, run.Tracks) {
+		t.Errorf("expected %v, got %v", run.Tracks, actual)
+	}
+}
+
+func TestGenerateRecipesPlan(t *testing.T) {
+	dir := testTempDir(t)
+	defer os.RemoveAll(dir)
+
+	defaults := testOptions(dir)
+	defaults.Dry = true
+	defaults.PlanFile = filepath.Join(dir, "plan.json")
+
+	recipes := &Recipes{
+		Recipes: []*Recipe{
+			{Name: "target", Size: testInt(5)},
+			{Name: "fresh", Size: testInt(6), Sources: "name:^(January|February)"},
+		},
+	}
+
+	all, err := recipes.Options(defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := testGenerate(t, testLibrary(), all...)
+
+	if calls := mutatingCalls(fake); len(calls) != 0 {
+		t.Errorf("expected a dry run to change nothing, got %v", calls)
+	}
+
+	plans := readPlans(t, defaults.PlanFile)
+	if len(plans.Plans) != 2 {
+		t.Fatalf("expected a plan for each recipe, got %d", len(plans.Plans))
+	}
+
+	for i, expected := range []struct {
+		name     string
+		selected int
+		id       spotify.ID
+	}{{"target", 5, "target"}, {"fresh", 6, ""}} {
+		plan := plans.Plans[i]
+		if plan.Name != expected.name || len(plan.Selected) != expected.selected || plan.PlaylistID != expected.id {
+			t.Errorf("expected %s with %d selected, got %s with %d", expected.name, expected.selected, plan.Name, len(plan.Selected))
+		}
+	}
+}
+
+func TestGenerateLibraryFixture(t *testing.T) {
+	tests := []struct {
+		name  string
+		dry   bool
+		calls []string
+	}{
+		{"dry run", true, []string{}},
+		{"update", false, []string{"RemoveTracksFromPlaylist target 2", "AddTracksToPlaylist target 20"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testTempDir(t)
+			defer os.RemoveAll(dir)
+
+			fake, err := LoadFakeMusicService("fixtures/library.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			options := testOptions(dir)
+			options.Self = "jlewalle"
+			options.User = "jlewalle"
+			options.Name = "rediscover weekly"
+			options.Size = 20
+			options.Dry = test.dry
+			options.PlanFile = filepath.Join(dir, "plan.json")
+
+			monthly := make(map[string]bool)
+			for _, id := range []spotify.ID{"pl0", "pl1", "pl2", "pl3", "pl4"} {
+				for _, track := range playlistIds(fake, id) {
+					monthly[track] = true
+				}
+			}
+
+			testGenerateWith(t, fake, options)
+
+			if calls := mutatingCalls(fake); !reflect.DeepEqual(calls, test.calls) {
+				t.Errorf("expected calls %v, got %v", test.calls, calls)
+			}
+
+			if test.dry {
+				plans := readPlans(t, options.PlanFile)
+				if len(plans.Plans) != 1 || len(plans.Plans[0].Sources) != 5 || len(plans.Plans[0].Selected) != 20 {
+					t.Errorf("unexpected plans: %+v", plans.Plans)
+				}
+				return
+			}
+
+			after := playlistIds(fake, "target")
+			seen := make(map[string]bool)
+			for _, track := range after {
+				if !monthly[track] || seen[track] {
+					t.Errorf("unexpected %s in %v", track, after)
+				}
+				seen[track] = true
+			}
+			if len(after) != 20 {
+				t.Errorf("expected 20 tracks, got %d", len(after))
+			}
+		})
+	}
+}
@@ -4,7 +4,8 @@ go 1.12
 
 require (
 	github.com/deckarep/golang-set v1.7.1
-	github.com/gorilla/mux v1.7.4 // indirect
-	github.com/zmb3/spotify v0.0.0-20191213135453-f2845aa57886
+	github.com/gorilla/mux v1.7.4
+	github.com/zmb3/spotify v1.3.0
+	go.etcd.io/bbolt v1.3.5
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
 )
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/zmb3/spotify"
+)
+
+type HistoryRun struct {
+	PlaylistID spotify.ID   `json:"playlistId"`
+	Name       string       `json:"name"`
+	At         time.Time    `json:"at"`
+	Seed       int64        `json:"seed"`
+	Tracks     []spotify.ID `json:"tracks"`
+}
+
+type History struct {
+	Runs []*HistoryRun `json:"runs"`
+}
+
+func LoadHistory(path string) (history *History, err error) {
+	history = &History{
+		Runs: make([]*HistoryRun, 0),
+	}
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return history, nil
+	}
+
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading history: %v", err)
+	}
+
+	err = json.Unmarshal(file, history)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling history: %v", err)
+	}
+
+	return
+}
+
+func (h *History) Save(path string) error {
+	json, err := json.Marshal(h)
+	if err != nil {
+		return fmt.Errorf("error saving history: %v", err)
+	}
+
+	err = WriteFileAtomic(path, json, 0644)
+	if err != nil {
+		return fmt.Errorf("error saving history: %v", err)
+	}
+
+	return nil
+}
+
+func (h *History) Record(id spotify.ID, name string, at time.Time, seed int64, tracks *TracksSet) *HistoryRun {
+	run := &HistoryRun{
+		PlaylistID: id,
+		Name:       name,
+		At:         at,
+		Seed:       seed,
+		Tracks:     tracks.ToArray(),
+	}
+
+	h.Runs = append(h.Runs, run)
+
+	return run
+}
+
+// ServedBetween is what runs from since up to, but not including, until
+// served, so reproducing a run with its time leaves out only what came before
+// it.
+func (h *History) ServedBetween(id spotify.ID, since, until time.Time) *TracksSet {
+	served := NewEmptyTracksSet()
+	for _, run := range h.Runs {
+		if run.PlaylistID != id || run.At.Before(since) || !run.At.Before(until) {
+			continue
+		}
+
+		for _, track := range run.Tracks {
+			if !served.Contains(track) {
+				served.Add(track)
+			}
+		}
+	}
+	return served
+}
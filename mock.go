@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+
+	"github.com/gorilla/mux"
+	"github.com/zmb3/spotify"
+)
+
+type MockFailure struct {
+	Status     int
+	Remaining  int
+	Path       string
+	RetryAfter int
+}
+
+// Failures are written as status:count:path, path being a substring of the
+// request path, for example "429:2:/tracks,503:1:".
+func ParseMockFailures(value string) ([]*MockFailure, error) {
+	failures := make([]*MockFailure, 0)
+	for _, term := range strings.Split(value, ",") {
+		if strings.TrimSpace(term) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(term, ":", 3)
+		status, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid mock failure '%s': %v", term, err)
+		}
+
+		failure := &MockFailure{
+			Status:     status,
+			Remaining:  1,
+			RetryAfter: 1,
+		}
+
+		if len(parts) > 1 && parts[1] != "" {
+			failure.Remaining, err = strconv.Atoi(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid mock failure '%s': %v", term, err)
+			}
+		}
+
+		if len(parts) > 2 {
+			failure.Path = parts[2]
+		}
+
+		failures = append(failures, failure)
+	}
+	return failures, nil
+}
+
+type MockSpotifyServer struct {
+	Server    *httptest.Server
+	service   *FakeMusicService
+	lock      sync.Mutex
+	failures  []*MockFailure
+	tokens    map[string]bool
+	challenge string
+	issued    int
+	ExpiresIn int
+	Requests  []string
+}
+
+func NewMockSpotifyServer(service *FakeMusicService) *MockSpotifyServer {
+	m := &MockSpotifyServer{
+		service:   service,
+		failures:  make([]*MockFailure, 0),
+		tokens:    make(map[string]bool),
+		ExpiresIn: 3600,
+		Requests:  make([]string, 0),
+	}
+
+	router := mux.NewRouter()
+
+	router.HandleFunc("/authorize", m.authorize).Methods("GET")
+	router.HandleFunc("/api/token", m.token).Methods("POST")
+
+	api := router.PathPrefix("/v1").Subrouter()
+	api.Use(m.authenticated)
+	api.HandleFunc("/me", m.handler(m.currentUser)).Methods("GET")
+	api.HandleFunc("/users/{user}/playlists", m.handler(m.getPlaylists)).Methods("GET")
+	api.HandleFunc("/users/{user}/playlists", m.handler(m.createPlaylist)).Methods("POST")
+	api.HandleFunc("/playlists/{id}/tracks", m.handler(m.getPlaylistTracks)).Methods("GET")
+	api.HandleFunc("/playlists/{id}/tracks", m.handler(m.addPlaylistTracks)).Methods("POST")
+	api.HandleFunc("/playlists/{id}/tracks", m.handler(m.removePlaylistTracks)).Methods("DELETE")
+	api.HandleFunc("/playlists/{id}/tracks", m.handler(m.replaceOrReorderPlaylistTracks)).Methods("PUT")
+	api.HandleFunc("/albums/{id}", m.handler(m.getAlbum)).Methods("GET")
+	api.HandleFunc("/albums/{id}/tracks", m.handler(m.getAlbumTracks)).Methods("GET")
+	api.HandleFunc("/artists/{id}/albums", m.handler(m.getArtistAlbums)).Methods("GET")
+	api.HandleFunc("/tracks", m.handler(m.getTracks)).Methods("GET")
+
+	m.Server = httptest.NewServer(m.failing(router))
+
+	return m
+}
+
+func (m *MockSpotifyServer) Close() {
+	m.Server.Close()
+}
+
+func (m *MockSpotifyServer) URL() string {
+	return m.Server.URL
+}
+
+// mockTransport sends requests for the real spotify api to the mock, so
+// clients are built just as they are for spotify itself.
+type mockTransport struct {
+	Base http.RoundTripper
+	URL  *url.URL
+}
+
+func (t *mockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != "api.spotify.com" {
+		return t.Base.RoundTrip(req)
+	}
+
+	rewritten := *req.URL
+	rewritten.Scheme = t.URL.Scheme
+	rewritten.Host = t.URL.Host
+
+	mocked := req.WithContext(req.Context())
+	mocked.URL = &rewritten
+	mocked.Host = ""
+
+	return t.Base.RoundTrip(mocked)
+}
+
+func (m *MockSpotifyServer) Transport() http.RoundTripper {
+	mocked, _ := url.Parse(m.Server.URL)
+	return &mockTransport{
+		Base: http.DefaultTransport,
+		URL:  mocked,
+	}
+}
+
+func (m *MockSpotifyServer) Fail(failures ...*MockFailure) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.failures = append(m.failures, failures...)
+}
+
+func (m *MockSpotifyServer) OAuthConfig(redirectURL string) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     "mock-client",
+		ClientSecret: "mock-secret",
+		RedirectURL:  redirectURL,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  m.Server.URL + "/authorize",
+			TokenURL: m.Server.URL + "/api/token",
+		},
+	}
+}
+
+// Client runs the authorization code flow against the mock, the same way a
+// browser would, and returns a client using the resulting token.
+func (m *MockSpotifyServer) Client(retry *RetryPolicy) (*spotify.Client, error) {
+	config := m.OAuthConfig("http://localhost/spotify/callback")
+
+	noRedirects := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	state := "mock-state"
+	res, err := noRedirects.Get(config.AuthCodeURL(state))
+	if err != nil {
+		return nil, fmt.Errorf("mock authorize failed: %v", err)
+	}
+	res.Body.Close()
+
+	redirected, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		return nil, fmt.Errorf("mock authorize failed: %v", err)
+	}
+
+	if redirected.Query().Get("state") != state {
+		return nil, fmt.Errorf("mock authorize state mismatch")
+	}
+
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: m.Transport()})
+	token, err := config.Exchange(ctx, redirected.Query().Get("code"))
+	if err != nil {
+		return nil, fmt.Errorf("mock token exchange failed: %v", err)
+	}
+
+	client := spotify.NewClient(retry.Client(config.Client(ctx, token)))
+
+	return &client, nil
+}
+
+func (m *MockSpotifyServer) failing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.lock.Lock()
+		m.Requests = append(m.Requests, fmt.Sprintf("%s %s", r.Method, r.URL.RequestURI()))
+		var failure *MockFailure
+		for _, f := range m.failures {
+			if f.Remaining > 0 && strings.Contains(r.URL.Path, f.Path) {
+				f.Remaining -= 1
+				failure = f
+				break
+			}
+		}
+		m.lock.Unlock()
+
+		if failure != nil {
+			log.Printf("[mock] failing %s %s with %d", r.Method, r.URL.Path, failure.Status)
+			if failure.Status == http.StatusTooManyRequests {
+				w.Header().Set("Retry-After", strconv.Itoa(failure.RetryAfter))
+			}
+			mockError(w, failure.Status, http.StatusText(failure.Status))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (m *MockSpotifyServer) authenticated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		m.lock.Lock()
+		valid := m.tokens[token]
+		m.lock.Unlock()
+
+		if !valid {
+			mockError(w, http.StatusUnauthorized, "invalid access token")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func mockError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]spotify.Error{
+		"error": spotify.Error{Status: status, Message: message},
+	})
+}
+
+func (m *MockSpotifyServer) handler(h func(r *http.Request) (int, interface{}, error)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, body, err := h(r)
+		if err != nil {
+			mockError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if body != nil {
+			json.NewEncoder(w).Encode(body)
+		}
+	}
+}
+
+func (m *MockSpotifyServer) authorize(w http.ResponseWriter, r *http.Request) {
+	redirect, err := url.Parse(r.URL.Query().Get("redirect_uri"))
+	if err != nil || redirect.String() == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	m.lock.Lock()
+	m.challenge = r.URL.Query().Get("code_challenge")
+	m.lock.Unlock()
+
+	q := redirect.Query()
+	q.Set("code", "mock-code")
+	q.Set("state", r.URL.Query().Get("state"))
+	redirect.RawQuery = q.Encode()
+
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (m *MockSpotifyServer) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		if r.PostForm.Get("code") != "mock-code" {
+			mockTokenError(w, "invalid_grant")
+			return
+		}
+		if !m.verified(r.PostForm.Get("code_verifier")) {
+			mockTokenError(w, "invalid_grant")
+			return
+		}
+	case "refresh_token":
+		if !strings.HasPrefix(r.PostForm.Get("refresh_token"), "mock-refresh") {
+			mockTokenError(w, "invalid_grant")
+			return
+		}
+	default:
+		mockTokenError(w, "unsupported_grant_type")
+		return
+	}
+
+	m.lock.Lock()
+	m.issued += 1
+	access := fmt.Sprintf("mock-access-%d", m.issued)
+	m.tokens[access] = true
+	expiresIn := m.ExpiresIn
+	m.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":  access,
+		"token_type":    "Bearer",
+		"refresh_token": "mock-refresh",
+		"expires_in":    expiresIn,
+	})
+}
+
+// PKCE is only checked when the authorization asked for it.
+func (m *MockSpotifyServer) verified(verifier string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.challenge == "" {
+		return true
+	}
+
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:]) == m.challenge
+}
+
+func mockTokenError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	io.WriteString(w, fmt.Sprintf(`{"error":"%s"}`, code))
+}
+
+func mockOptions(r *http.Request) (*spotify.Options, error) {
+	options := &spotify.Options{}
+	for _, key := range []string{"limit", "offset"} {
+		if raw := r.URL.Query().Get(key); raw != "" {
+			value, err := strconv.Atoi(raw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", key, err)
+			}
+			if key == "limit" {
+				options.Limit = &value
+			} else {
+				options.Offset = &value
+			}
+		}
+	}
+	return options, nil
+}
+
+func trackIdsFromUris(uris []string) []spotify.ID {
+	ids := make([]spotify.ID, 0)
+	for _, uri := range uris {
+		ids = append(ids, spotify.ID(strings.TrimPrefix(uri, "spotify:track:")))
+	}
+	return ids
+}
+
+func snapshot(id string) map[string]string {
+	return map[string]string{"snapshot_id": id}
+}
+
+func (m *MockSpotifyServer) currentUser(r *http.Request) (int, interface{}, error) {
+	user, err := m.service.CurrentUser()
+	return http.StatusOK, user, err
+}
+
+func (m *MockSpotifyServer) getPlaylists(r *http.Request) (int, interface{}, error) {
+	options, err := mockOptions(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	page, err := m.service.GetPlaylistsForUserOpt(mux.Vars(r)["user"], options)
+	return http.StatusOK, page, err
+}
+
+func (m *MockSpotifyServer) createPlaylist(r *http.Request) (int, interface{}, error) {
+	body := struct {
+		Name        string `json:"name"`
+		Public      bool   `json:"public"`
+		Description string `json:"description"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return 0, nil, err
+	}
+	pl, err := m.service.CreatePlaylistForUser(mux.Vars(r)["user"], body.Name, body.Description, body.Public)
+	return http.StatusCreated, pl, err
+}
+
+func (m *MockSpotifyServer) getPlaylistTracks(r *http.Request) (int, interface{}, error) {
+	options, err := mockOptions(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	page, err := m.service.GetPlaylistTracksOpt(spotify.ID(mux.Vars(r)["id"]), options, "")
+	return http.StatusOK, page, err
+}
+
+func (m *MockSpotifyServer) addPlaylistTracks(r *http.Request) (int, interface{}, error) {
+	body := struct {
+		Uris []string `json:"uris"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return 0, nil, err
+	}
+	if len(body.Uris) > 100 {
+		return 0, nil, fmt.Errorf("too many tracks: %d", len(body.Uris))
+	}
+	id, err := m.service.AddTracksToPlaylist(spotify.ID(mux.Vars(r)["id"]), trackIdsFromUris(body.Uris)...)
+	return http.StatusCreated, snapshot(id), err
+}
+
+func (m *MockSpotifyServer) removePlaylistTracks(r *http.Request) (int, interface{}, error) {
+	body := struct {
+		Tracks []struct {
+			URI string `json:"uri"`
+		} `json:"tracks"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return 0, nil, err
+	}
+	if len(body.Tracks) > 100 {
+		return 0, nil, fmt.Errorf("too many tracks: %d", len(body.Tracks))
+	}
+	uris := make([]string, 0)
+	for _, t := range body.Tracks {
+		uris = append(uris, t.URI)
+	}
+	id, err := m.service.RemoveTracksFromPlaylist(spotify.ID(mux.Vars(r)["id"]), trackIdsFromUris(uris)...)
+	return http.StatusOK, snapshot(id), err
+}
+
+func (m *MockSpotifyServer) replaceOrReorderPlaylistTracks(r *http.Request) (int, interface{}, error) {
+	id := spotify.ID(mux.Vars(r)["id"])
+
+	if _, ok := r.URL.Query()["uris"]; ok {
+		uris := make([]string, 0)
+		if raw := r.URL.Query().Get("uris"); raw != "" {
+			uris = strings.Split(raw, ",")
+		}
+		err := m.service.ReplacePlaylistTracks(id, trackIdsFromUris(uris)...)
+		return http.StatusCreated, nil, err
+	}
+
+	opt := spotify.PlaylistReorderOptions{}
+	if err := json.NewDecoder(r.Body).Decode(&opt); err != nil {
+		return 0, nil, err
+	}
+	snapshotID, err := m.service.ReorderPlaylistTracks(id, opt)
+	return http.StatusOK, snapshot(snapshotID), err
+}
+
+func (m *MockSpotifyServer) getAlbum(r *http.Request) (int, interface{}, error) {
+	album, err := m.service.GetAlbum(spotify.ID(mux.Vars(r)["id"]))
+	return http.StatusOK, album, err
+}
+
+func (m *MockSpotifyServer) getAlbumTracks(r *http.Request) (int, interface{}, error) {
+	options, err := mockOptions(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	page, err := m.service.GetAlbumTracksOpt(spotify.ID(mux.Vars(r)["id"]), options)
+	return http.StatusOK, page, err
+}
+
+func (m *MockSpotifyServer) getArtistAlbums(r *http.Request) (int, interface{}, error) {
+	options, err := mockOptions(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	page, err := m.service.GetArtistAlbumsOpt(spotify.ID(mux.Vars(r)["id"]), options)
+	return http.StatusOK, page, err
+}
+
+func (m *MockSpotifyServer) getTracks(r *http.Request) (int, interface{}, error) {
+	ids := make([]spotify.ID, 0)
+	for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if id != "" {
+			ids = append(ids, spotify.ID(id))
+		}
+	}
+	tracks, err := m.service.GetTracks(ids...)
+	return http.StatusOK, map[string]interface{}{"tracks": tracks}, err
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zmb3/spotify"
+	"golang.org/x/oauth2"
+)
+
+func testRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Millisecond,
+		MaxDelay:    10 * time.Millisecond,
+		Stats:       &RetryStats{},
+	}
+}
+
+func testMock(t *testing.T, fixture *FakeFixture, retry *RetryPolicy) (*MockSpotifyServer, *spotify.Client) {
+	m := NewMockSpotifyServer(NewFakeMusicService(fixture))
+	client, err := m.Client(retry)
+	if err != nil {
+		m.Close()
+		t.Fatal(err)
+	}
+	return m, client
+}
+
+func (m *MockSpotifyServer) requested(method, path string) []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	matching := make([]string, 0)
+	for _, r := range m.Requests {
+		if strings.HasPrefix(r, method+" "+path) {
+			matching = append(matching, r)
+		}
+	}
+	return matching
+}
+
+func TestMockPagination(t *testing.T) {
+	tests := []struct {
+		tracks int
+		pages  int
+	}{
+		{0, 1},
+		{99, 1},
+		{100, 2},
+		{250, 3},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%d tracks", test.tracks), func(t *testing.T) {
+			tracks := testTracks("t", test.tracks, testEpoch)
+			m, client := testMock(t, testFixture(testPlaylist("pl", "Playlist", tracks)), testRetryPolicy())
+			defer m.Close()
+
+			all, err := GetPlaylistTracks(client, "pl")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if actual, expected := testTrackIds(all), testTrackIds(tracks); !reflect.DeepEqual(actual, expected) {
+				t.Errorf("expected %d tracks in order, got %d", len(expected), len(actual))
+			}
+
+			if pages := m.requested("GET", "/v1/playlists/pl/tracks"); len(pages) != test.pages {
+				t.Errorf("expected %d pages, got %v", test.pages, pages)
+			}
+		})
+	}
+}
+
+func TestMockAddTracksBatching(t *testing.T) {
+	m, client := testMock(t, testFixture(testPlaylist("pl", "Playlist", nil)), testRetryPolicy())
+	defer m.Close()
+
+	ids := make([]spotify.ID, 0)
+	expected := make([]string, 0)
+	for i := 0; i < 250; i++ {
+		ids = append(ids, spotify.ID(fmt.Sprintf("t%d", i)))
+		expected = append(expected, fmt.Sprintf("t%d", i))
+	}
+
+	if err := AddTracksToPlaylist(client, "pl", ids); err != nil {
+		t.Fatal(err)
+	}
+
+	posts := m.requested("POST", "/v1/playlists/pl/tracks")
+	if len(posts) != 5 {
+		t.Errorf("expected 5 batches, got %d", len(posts))
+	}
+
+	pl, _ := m.service.playlist("pl")
+	if actual := testTrackIds(pl.Tracks); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %d tracks in order, got %d", len(expected), len(actual))
+	}
+}
+
+func TestMockRejectsLargeBatches(t *testing.T) {
+	m, client := testMock(t, testFixture(testPlaylist("pl", "Playlist", nil)), testRetryPolicy())
+	defer m.Close()
+
+	ids := make([]spotify.ID, 0)
+	for i := 0; i < 101; i++ {
+		ids = append(ids, spotify.ID(fmt.Sprintf("t%d", i)))
+	}
+
+	if _, err := client.AddTracksToPlaylist("pl", ids...); err == nil {
+		t.Fatalf("expected more than 100 tracks to be rejected")
+	}
+}
+
+func TestMockRetries(t *testing.T) {
+	tests := []struct {
+		name        string
+		failure     *MockFailure
+		call        func(client *spotify.Client) error
+		fails       bool
+		attempts    int
+		rateLimited int
+		serverError int
+		waited      time.Duration
+	}{
+		{
+			name:    "429 honours retry-after",
+			failure: &MockFailure{Status: http.StatusTooManyRequests, Remaining: 1, Path: "/tracks", RetryAfter: 1},
+			call: func(client *spotify.Client) error {
+				_, err := GetPlaylistTracks(client, "pl")
+				return err
+			},
+			attempts:    2,
+			rateLimited: 1,
+			waited:      time.Second,
+		},
+		{
+			name:    "429 retries adds",
+			failure: &MockFailure{Status: http.StatusTooManyRequests, Remaining: 1, Path: "/tracks"},
+			call: func(client *spotify.Client) error {
+				_, err := client.AddTracksToPlaylist("pl", "added")
+				return err
+			},
+			attempts:    2,
+			rateLimited: 1,
+		},
+		{
+			name:    "503 retries reads",
+			failure: &MockFailure{Status: http.StatusServiceUnavailable, Remaining: 2, Path: "/tracks"},
+			call: func(client *spotify.Client) error {
+				_, err := GetPlaylistTracks(client, "pl")
+				return err
+			},
+			attempts:    3,
+			serverError: 2,
+		},
+		{
+			name:    "503 gives up on reads",
+			failure: &MockFailure{Status: http.StatusServiceUnavailable, Remaining: 5, Path: "/tracks"},
+			call: func(client *spotify.Client) error {
+				_, err := GetPlaylistTracks(client, "pl")
+				return err
+			},
+			fails:       true,
+			attempts:    3,
+			serverError: 2,
+		},
+		{
+			name:    "503 never retries adds",
+			failure: &MockFailure{Status: http.StatusServiceUnavailable, Remaining: 1, Path: "/tracks"},
+			call: func(client *spotify.Client) error {
+				_, err := client.AddTracksToPlaylist("pl", "added")
+				return err
+			},
+			fails:    true,
+			attempts: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			retry := testRetryPolicy()
+			m, client := testMock(t, testFixture(testPlaylist("pl", "Playlist", testTracks("t", 3, testEpoch))), retry)
+			defer m.Close()
+
+			m.Fail(test.failure)
+
+			started := time.Now()
+			err := test.call(client)
+			if test.fails && err == nil {
+				t.Fatalf("expected an error")
+			}
+			if !test.fails && err != nil {
+				t.Fatal(err)
+			}
+
+			if elapsed := time.Since(started); elapsed < test.waited {
+				t.Errorf("expected to wait at least %v, waited %v", test.waited, elapsed)
+			}
+
+			attempts := len(m.requested("GET", "/v1/playlists/pl/tracks")) + len(m.requested("POST", "/v1/playlists/pl/tracks"))
+			if attempts != test.attempts {
+				t.Errorf("expected %d attempts, got %d: %v", test.attempts, attempts, m.Requests)
+			}
+
+			stats := retry.Stats
+			if stats.RateLimited != test.rateLimited || stats.ServerError != test.serverError {
+				t.Errorf("unexpected stats: %v", stats)
+			}
+		})
+	}
+}
+
+func TestMockTokenExchange(t *testing.T) {
+	m := NewMockSpotifyServer(NewFakeMusicService(testFixture()))
+	defer m.Close()
+
+	config := m.OAuthConfig("http://localhost/spotify/callback")
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: m.Transport()})
+
+	if _, err := config.Exchange(ctx, "wrong-code"); err == nil {
+		t.Fatalf("expected an unknown code to be rejected")
+	}
+
+	token, err := config.Exchange(ctx, "mock-code")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token.AccessToken != "mock-access-1" || token.RefreshToken != "mock-refresh" {
+		t.Errorf("unexpected token: %+v", token)
+	}
+
+	if until := time.Until(token.Expiry); until < 59*time.Minute || until > time.Hour {
+		t.Errorf("unexpected expiry: %v", token.Expiry)
+	}
+}
+
+func TestMockTokenRefresh(t *testing.T) {
+	m := NewMockSpotifyServer(NewFakeMusicService(testFixture()))
+	defer m.Close()
+
+	// Tokens expiring within a few seconds are already stale to oauth2, so
+	// every request refreshes.
+	m.ExpiresIn = 1
+
+	client, err := m.Client(testRetryPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		user, err := client.CurrentUser()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.ID != "tester" {
+			t.Errorf("unexpected user: %v", user.ID)
+		}
+	}
+
+	if tokens := m.requested("POST", "/api/token"); len(tokens) != 3 {
+		t.Errorf("expected an exchange and two refreshes, got %v", tokens)
+	}
+}
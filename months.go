@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zmb3/spotify"
+)
+
+var (
+	monthlyFilter = regexp.MustCompile("[^A-Za-z0-9\\s]")
+	monthlyName   = regexp.MustCompile("(?i)^(?:(\\d\\d\\d\\d) )?(january|february|march|april|may|june|july|august|september|october|november|december)(?: (\\d\\d\\d\\d))?$")
+)
+
+type PlaylistMonth struct {
+	Year  int
+	Month time.Month
+}
+
+func ParseMonthlyName(name string) (pm PlaylistMonth, ok bool) {
+	filtered := monthlyFilter.ReplaceAllString(name, "")
+
+	m := monthlyName.FindStringSubmatch(filtered)
+	if m == nil {
+		return pm, false
+	}
+
+	for month := time.January; month <= time.December; month++ {
+		if strings.EqualFold(month.String(), m[2]) {
+			pm.Month = month
+		}
+	}
+
+	for _, year := range []string{m[1], m[3]} {
+		if year != "" {
+			pm.Year, _ = strconv.Atoi(year)
+		}
+	}
+
+	return pm, true
+}
+
+func (pm PlaylistMonth) HasYear() bool {
+	return pm.Year > 0
+}
+
+func (pm PlaylistMonth) Time() time.Time {
+	return time.Date(pm.Year, pm.Month, 1, 0, 0, 0, 0, time.UTC)
+}
+
+func (pm PlaylistMonth) Before(o PlaylistMonth) bool {
+	if pm.Year != o.Year {
+		return pm.Year < o.Year
+	}
+	return pm.Month < o.Month
+}
+
+func (pm PlaylistMonth) String() string {
+	if !pm.HasYear() {
+		return pm.Month.String()
+	}
+	return fmt.Sprintf("%04d-%02d", pm.Year, pm.Month)
+}
+
+// Playlists named without a year take the year most of their tracks were
+// added in.
+func ResolvePlaylistMonth(pl Playlist, tracks []spotify.PlaylistTrack) (pm PlaylistMonth, ok bool) {
+	pm, ok = ParseMonthlyName(pl.Name)
+	if !ok || pm.HasYear() {
+		return
+	}
+
+	years := make(map[int]int)
+	for _, t := range tracks {
+		addedAt, err := ParseAddedAt(t.AddedAt)
+		if err == nil {
+			years[addedAt.Year()] += 1
+		}
+	}
+
+	for year, n := range years {
+		if n > years[pm.Year] || (n == years[pm.Year] && year > pm.Year) {
+			pm.Year = year
+		}
+	}
+
+	return
+}
+
+func ParseYearMonth(value string, end bool) (pm PlaylistMonth, err error) {
+	if t, err := time.Parse("2006-01", value); err == nil {
+		return PlaylistMonth{Year: t.Year(), Month: t.Month()}, nil
+	}
+
+	if t, err := time.Parse("2006", value); err == nil {
+		if end {
+			return PlaylistMonth{Year: t.Year(), Month: time.December}, nil
+		}
+		return PlaylistMonth{Year: t.Year(), Month: time.January}, nil
+	}
+
+	return pm, fmt.Errorf("invalid year or month: %v", value)
+}
+
+func ParseMonths(value string) (int, error) {
+	if value == "" {
+		return 0, fmt.Errorf("empty months")
+	}
+
+	unit := value[len(value)-1]
+	n, err := strconv.Atoi(value[:len(value)-1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid months '%s': %v", value, err)
+	}
+
+	switch unit {
+	case 'y':
+		return n * 12, nil
+	case 'm':
+		return n, nil
+	}
+
+	return 0, fmt.Errorf("invalid months '%s', expected a y or m suffix", value)
+}
+
+func MonthsBetween(a, b PlaylistMonth) int {
+	return (b.Year-a.Year)*12 + int(b.Month) - int(a.Month)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zmb3/spotify"
+)
+
+func TestParseMonthlyName(t *testing.T) {
+	tests := []struct {
+		name     string
+		ok       bool
+		expected PlaylistMonth
+	}{
+		{"January 2019", true, PlaylistMonth{2019, time.January}},
+		{"2018 December", true, PlaylistMonth{2018, time.December}},
+		{"june, 2017", true, PlaylistMonth{2017, time.June}},
+		{"MAY '2016", true, PlaylistMonth{2016, time.May}},
+		{"april", true, PlaylistMonth{0, time.April}},
+		{"Summer Jams", false, PlaylistMonth{}},
+		{"January 2019 mix", false, PlaylistMonth{}},
+		{"January 19", false, PlaylistMonth{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pm, ok := ParseMonthlyName(test.name)
+			if ok != test.ok {
+				t.Fatalf("expected ok %v, got %v", test.ok, ok)
+			}
+			if ok && pm != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, pm)
+			}
+		})
+	}
+}
+
+func TestResolvePlaylistMonth(t *testing.T) {
+	at := func(year int) time.Time {
+		return time.Date(year, time.March, 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name     string
+		tracks   []spotify.PlaylistTrack
+		expected PlaylistMonth
+	}{
+		{"June 2018", testTracks("a", 3, at(2016)), PlaylistMonth{2018, time.June}},
+		{"june", append(testTracks("a", 3, at(2016)), testTracks("b", 1, at(2017))...), PlaylistMonth{2016, time.June}},
+		{"june", append(testTracks("a", 2, at(2016)), testTracks("b", 2, at(2017))...), PlaylistMonth{2017, time.June}},
+		{"june", nil, PlaylistMonth{0, time.June}},
+	}
+
+	for _, test := range tests {
+		pm, ok := ResolvePlaylistMonth(Playlist{Name: test.name}, test.tracks)
+		if !ok || pm != test.expected {
+			t.Errorf("%s: expected %v, got %v (%v)", test.name, test.expected, pm, ok)
+		}
+	}
+
+	if _, ok := ResolvePlaylistMonth(Playlist{Name: "Summer"}, testTracks("a", 3, at(2016))); ok {
+		t.Errorf("expected only monthly playlists to resolve")
+	}
+}
+
+func TestParseYearMonth(t *testing.T) {
+	tests := []struct {
+		value    string
+		end      bool
+		fails    bool
+		expected PlaylistMonth
+	}{
+		{"2019", false, false, PlaylistMonth{2019, time.January}},
+		{"2019", true, false, PlaylistMonth{2019, time.December}},
+		{"2019-06", false, false, PlaylistMonth{2019, time.June}},
+		{"2019-06", true, false, PlaylistMonth{2019, time.June}},
+		{"2019-13", false, true, PlaylistMonth{}},
+		{"June 2019", false, true, PlaylistMonth{}},
+	}
+
+	for _, test := range tests {
+		pm, err := ParseYearMonth(test.value, test.end)
+		if test.fails != (err != nil) {
+			t.Errorf("%s: expected fails %v, got %v", test.value, test.fails, err)
+		} else if !test.fails && pm != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.value, test.expected, pm)
+		}
+	}
+}
+
+func TestParseMonths(t *testing.T) {
+	tests := []struct {
+		value    string
+		fails    bool
+		expected int
+	}{
+		{"2y", false, 24},
+		{"18m", false, 18},
+		{"0m", false, 0},
+		{"2w", true, 0},
+		{"y", true, 0},
+		{"", true, 0},
+	}
+
+	for _, test := range tests {
+		n, err := ParseMonths(test.value)
+		if test.fails != (err != nil) {
+			t.Errorf("%s: expected fails %v, got %v", test.value, test.fails, err)
+		} else if n != test.expected {
+			t.Errorf("%s: expected %d, got %d", test.value, test.expected, n)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/zmb3/spotify"
+)
+
+// OfflineMusicService stands in for spotify when running purely from the
+// cache, anything that reaches it wasn't cached and fails.
+type OfflineMusicService struct {
+}
+
+func offline(format string, args ...interface{}) error {
+	return fmt.Errorf("offline: %s isn't in the cache", fmt.Sprintf(format, args...))
+}
+
+func offlineWrite(action string) error {
+	return fmt.Errorf("offline: can't %s", action)
+}
+
+func (o *OfflineMusicService) CurrentUser() (*spotify.PrivateUser, error) {
+	return nil, offline("current user")
+}
+
+func (o *OfflineMusicService) GetPlaylistsForUserOpt(userID string, opt *spotify.Options) (*spotify.SimplePlaylistPage, error) {
+	return nil, offline("playlists for %s", userID)
+}
+
+func (o *OfflineMusicService) GetPlaylistTracksOpt(playlistID spotify.ID, opt *spotify.Options, fields string) (*spotify.PlaylistTrackPage, error) {
+	return nil, offline("playlist %s", playlistID)
+}
+
+func (o *OfflineMusicService) CreatePlaylistForUser(userID, playlistName, description string, public bool) (*spotify.FullPlaylist, error) {
+	return nil, offlineWrite(fmt.Sprintf("create playlist '%s'", playlistName))
+}
+
+func (o *OfflineMusicService) AddTracksToPlaylist(playlistID spotify.ID, trackIDs ...spotify.ID) (string, error) {
+	return "", offlineWrite("add tracks")
+}
+
+func (o *OfflineMusicService) RemoveTracksFromPlaylist(playlistID spotify.ID, trackIDs ...spotify.ID) (string, error) {
+	return "", offlineWrite("remove tracks")
+}
+
+func (o *OfflineMusicService) ReorderPlaylistTracks(playlistID spotify.ID, opt spotify.PlaylistReorderOptions) (string, error) {
+	return "", offlineWrite("reorder tracks")
+}
+
+func (o *OfflineMusicService) ReplacePlaylistTracks(playlistID spotify.ID, trackIDs ...spotify.ID) error {
+	return offlineWrite("replace tracks")
+}
+
+func (o *OfflineMusicService) GetAlbum(id spotify.ID) (*spotify.FullAlbum, error) {
+	return nil, offline("album %s", id)
+}
+
+func (o *OfflineMusicService) GetAlbumTracksOpt(id spotify.ID, opt *spotify.Options) (*spotify.SimpleTrackPage, error) {
+	return nil, offline("album tracks %s", id)
+}
+
+func (o *OfflineMusicService) GetArtistAlbumsOpt(artistID spotify.ID, options *spotify.Options, ts ...spotify.AlbumType) (*spotify.SimpleAlbumPage, error) {
+	return nil, offline("albums by %s", artistID)
+}
+
+func (o *OfflineMusicService) GetTracks(ids ...spotify.ID) ([]*spotify.FullTrack, error) {
+	return nil, offline("tracks %v", ids)
+}
+
+var _ MusicService = &OfflineMusicService{}
+
+// Offline runs find the target playlist in the cached playlists instead of
+// searching for, or creating, it on spotify.
+func GetCachedPlaylist(cacher *SpotifyCacher, user, name string) (*spotify.SimplePlaylist, error) {
+	playlists, err := cacher.GetPlaylists(user)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pl := range playlists.Playlists {
+		if strings.EqualFold(pl.Name, name) {
+			found := &spotify.SimplePlaylist{
+				ID:         pl.ID,
+				Name:       pl.Name,
+				SnapshotID: pl.SnapshotID,
+			}
+			found.Owner.ID = pl.Owner
+			return found, nil
+		}
+	}
+
+	return nil, offline("playlist '%s' for %s", name, user)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync"
+)
+
+// Parallel calls f for every index below n, running at most concurrency at
+// once. No new calls are started after one fails and the first error is
+// returned.
+func Parallel(concurrency int, n int, f func(i int) error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var lock sync.Mutex
+	var first error
+
+	failed := func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return first != nil
+	}
+
+	indices := make(chan int)
+	go func() {
+		defer close(indices)
+		for i := 0; i < n && !failed(); i++ {
+			indices <- i
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < min(concurrency, n); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				if failed() {
+					continue
+				}
+				if err := f(i); err != nil {
+					lock.Lock()
+					if first == nil {
+						first = err
+					}
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return first
+}
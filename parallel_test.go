@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestParallel(t *testing.T) {
+	tests := []struct {
+		name        string
+		concurrency int
+		n           int
+		fails       int
+		calls       int
+	}{
+		{"none", 4, 0, -1, 0},
+		{"all", 4, 50, -1, 50},
+		{"no concurrency", 0, 10, -1, 10},
+		{"stops after an error", 1, 50, 3, 4},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var lock sync.Mutex
+			calls := 0
+			running := 0
+
+			err := Parallel(test.concurrency, test.n, func(i int) error {
+				lock.Lock()
+				calls += 1
+				running += 1
+				if running > test.concurrency && running > 1 {
+					t.Errorf("expected at most %d running, got %d", test.concurrency, running)
+				}
+				lock.Unlock()
+
+				defer func() {
+					lock.Lock()
+					running -= 1
+					lock.Unlock()
+				}()
+
+				if i == test.fails {
+					return fmt.Errorf("failed %d", i)
+				}
+				return nil
+			})
+
+			if test.fails >= 0 {
+				if err == nil || err.Error() != fmt.Sprintf("failed %d", test.fails) {
+					t.Errorf("expected the first error, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if calls != test.calls {
+				t.Errorf("expected %d calls, got %d", test.calls, calls)
+			}
+		})
+	}
+}
+
+func TestParallelFirstError(t *testing.T) {
+	calls := make(chan int, 100)
+
+	err := Parallel(4, cap(calls), func(i int) error {
+		calls <- i
+		return fmt.Errorf("failed %d", i)
+	})
+	close(calls)
+
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	// Each worker may have taken one more index before seeing the failure.
+	if len(calls) > 8 {
+		t.Errorf("expected calls to stop after the first error, got %d", len(calls))
+	}
+}
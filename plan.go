@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/zmb3/spotify"
+)
+
+type PlanSource struct {
+	ID     spotify.ID `json:"id"`
+	Name   string     `json:"name"`
+	Month  string     `json:"month,omitempty"`
+	Tracks int        `json:"tracks"`
+}
+
+type PlanTrack struct {
+	ID      spotify.ID `json:"id"`
+	Name    string     `json:"name"`
+	Artists []string   `json:"artists"`
+	Album   string     `json:"album"`
+	Sources []string   `json:"sources,omitempty"`
+	Month   string     `json:"month,omitempty"`
+	AddedAt *time.Time `json:"addedAt,omitempty"`
+	Reason  string     `json:"reason,omitempty"`
+}
+
+type Plan struct {
+	Name       string         `json:"name"`
+	PlaylistID spotify.ID     `json:"playlistId"`
+	Seed       int64          `json:"seed"`
+	Now        time.Time      `json:"now"`
+	Sampler    string         `json:"sampler"`
+	Selector   string         `json:"selector"`
+	Sources    []*PlanSource  `json:"sources"`
+	Pool       int            `json:"pool"`
+	Existing   int            `json:"existing"`
+	CooledDown int            `json:"cooledDown"`
+	Eligible   int            `json:"eligible"`
+	Kept       []*PlanTrack   `json:"kept"`
+	Selected   []*PlanTrack   `json:"selected"`
+	Remove     []*PlanTrack   `json:"remove"`
+	Add        []spotify.ID   `json:"add"`
+	Moves      []PlaylistMove `json:"moves"`
+}
+
+func newPlanTrack(track *spotify.FullTrack) *PlanTrack {
+	return &PlanTrack{
+		ID:      track.ID,
+		Name:    track.Name,
+		Artists: artistNames(track),
+		Album:   track.Album.Name,
+	}
+}
+
+func artistNames(track *spotify.FullTrack) []string {
+	names := make([]string, 0)
+	for _, a := range track.Artists {
+		names = append(names, a.Name)
+	}
+	return names
+}
+
+func (p *Plan) AddSource(pl Playlist, tracks []spotify.PlaylistTrack) {
+	source := &PlanSource{
+		ID:     pl.ID,
+		Name:   pl.Name,
+		Tracks: len(tracks),
+	}
+
+	if pm, ok := ResolvePlaylistMonth(pl, tracks); ok {
+		source.Month = pm.String()
+	}
+
+	p.Sources = append(p.Sources, source)
+}
+
+func (p *Plan) AddSelected(c *Candidate, cooldown time.Duration) {
+	pt := newPlanTrack(&c.Track.Track)
+	if !c.AddedAt.IsZero() {
+		addedAt := c.AddedAt
+		pt.AddedAt = &addedAt
+	}
+
+	for _, source := range c.Sources {
+		pt.Sources = append(pt.Sources, source.Name)
+		if pm, ok := ParseMonthlyName(source.Name); ok && pt.Month == "" {
+			pt.Month = pm.String()
+		}
+	}
+
+	reasons := []string{fmt.Sprintf("in %s", strings.Join(pt.Sources, ", "))}
+	if !c.AddedAt.IsZero() {
+		reasons = append(reasons, fmt.Sprintf("added %s", c.AddedAt.Format("2006-01-02")))
+	}
+	reasons = append(reasons, "not in target")
+	if cooldown > 0 {
+		reasons = append(reasons, fmt.Sprintf("not served in %s", formatDays(cooldown)))
+	}
+	pt.Reason = strings.Join(reasons, "; ")
+
+	p.Selected = append(p.Selected, pt)
+}
+
+func (p *Plan) AddExisting(existing []spotify.PlaylistTrack, kept *TracksSet, pu *PlaylistUpdate) {
+	removing := pu.GetIdsToRemove()
+	for _, t := range existing {
+		if kept.Contains(t.Track.ID) {
+			pt := newPlanTrack(&t.Track)
+			pt.Reason = "kept from current playlist"
+			p.Kept = append(p.Kept, pt)
+		} else if removing.Contains(t.Track.ID) {
+			p.Remove = append(p.Remove, newPlanTrack(&t.Track))
+		}
+	}
+
+	p.Add = pu.GetIdsToAdd().ToArray()
+	p.Moves = pu.GetMoves()
+}
+
+func writePlanTracks(w io.Writer, heading string, tracks []*PlanTrack) {
+	fmt.Fprintf(w, "\n%s (%d):\n", heading, len(tracks))
+	for i, t := range tracks {
+		fmt.Fprintf(w, "  %3d. %s - %s [%s]\n", i+1, strings.Join(t.Artists, ", "), t.Name, t.Album)
+		if t.Month != "" {
+			fmt.Fprintf(w, "       month: %s\n", t.Month)
+		}
+		if t.Reason != "" {
+			fmt.Fprintf(w, "       why: %s\n", t.Reason)
+		}
+	}
+}
+
+func (p *Plan) WriteText(w io.Writer) {
+	if p.PlaylistID == "" {
+		fmt.Fprintf(w, "plan for '%s' (new)\n", p.Name)
+	} else {
+		fmt.Fprintf(w, "plan for '%s' (%s)\n", p.Name, p.PlaylistID)
+	}
+	fmt.Fprintf(w, "seed: %d, now: %s, sampler: %s, sources: %s\n", p.Seed, p.Now.Format(time.RFC3339), p.Sampler, p.Selector)
+
+	fmt.Fprintf(w, "\nsource playlists (%d):\n", len(p.Sources))
+	for _, s := range p.Sources {
+		if s.Month != "" {
+			fmt.Fprintf(w, "  %s (%s, %d tracks)\n", s.Name, s.Month, s.Tracks)
+		} else {
+			fmt.Fprintf(w, "  %s (%d tracks)\n", s.Name, s.Tracks)
+		}
+	}
+
+	fmt.Fprintf(w, "\npool: %d tracks, %d already in target, %d cooling down, %d eligible\n", p.Pool, p.Existing, p.CooledDown, p.Eligible)
+
+	writePlanTracks(w, "kept", p.Kept)
+	writePlanTracks(w, "selected", p.Selected)
+	writePlanTracks(w, "remove", p.Remove)
+
+	fmt.Fprintf(w, "\nadd %d, remove %d, move %d\n", len(p.Add), len(p.Remove), len(p.Moves))
+}
+
+// Plans are written together so a run of several recipes is one document.
+type Plans struct {
+	Plans []*Plan `json:"plans"`
+}
+
+func (ps *Plans) Write(w io.Writer, format string) error {
+	switch format {
+	case "", "text":
+		for i, p := range ps.Plans {
+			if i > 0 {
+				fmt.Fprintf(w, "\n")
+			}
+			p.WriteText(w)
+		}
+		return nil
+	case "json":
+		data, err := json.MarshalIndent(ps, "", "  ")
+		if err != nil {
+			return fmt.Errorf("error marshalling plan: %v", err)
+		}
+
+		_, err = w.Write(append(data, '\n'))
+
+		return err
+	}
+	return fmt.Errorf("unknown plan format: %v", format)
+}
+
+// formatDays writes durations of whole weeks or days in those, the way
+// cooldowns are thought about.
+func formatDays(d time.Duration) string {
+	day := 24 * time.Hour
+	week := 7 * day
+	switch {
+	case d == week:
+		return "1 week"
+	case d > 0 && d%week == 0:
+		return fmt.Sprintf("%d weeks", d/week)
+	case d == day:
+		return "1 day"
+	case d > 0 && d%day == 0:
+		return fmt.Sprintf("%d days", d/day)
+	}
+	return d.String()
+}
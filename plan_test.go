@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatDays(t *testing.T) {
+	tests := []struct {
+		duration time.Duration
+		expected string
+	}{
+		{12 * 7 * 24 * time.Hour, "12 weeks"},
+		{7 * 24 * time.Hour, "1 week"},
+		{10 * 24 * time.Hour, "10 days"},
+		{24 * time.Hour, "1 day"},
+		{36 * time.Hour, "36h0m0s"},
+		{0, "0s"},
+	}
+
+	for _, test := range tests {
+		if actual := formatDays(test.duration); actual != test.expected {
+			t.Errorf("%v: expected %q, got %q", test.duration, test.expected, actual)
+		}
+	}
+}
+
+func TestPlanTracks(t *testing.T) {
+	dated := &Candidate{ID: "a", Track: testTrack("a", "artist", "album", testEpoch), AddedAt: testEpoch, Sources: []Playlist{{Name: "June 2019"}}}
+	undated := &Candidate{ID: "b", Track: testTrack("b", "artist", "album", testEpoch), Sources: []Playlist{{Name: "Summer Jams"}}}
+
+	plan := &Plan{Name: "target"}
+	plan.AddSelected(dated, 12*7*24*time.Hour)
+	plan.AddSelected(undated, 0)
+
+	if reason := plan.Selected[0].Reason; !strings.Contains(reason, "not served in 12 weeks") || !strings.Contains(reason, "added 2019-06-01") {
+		t.Errorf("unexpected reason: %s", reason)
+	}
+	if plan.Selected[0].Month != "2019-06" {
+		t.Errorf("unexpected month: %s", plan.Selected[0].Month)
+	}
+
+	buffer := new(bytes.Buffer)
+	if err := (&Plans{Plans: []*Plan{plan}}).Write(buffer, "json"); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := struct {
+		Plans []struct {
+			Selected []map[string]interface{} `json:"selected"`
+		} `json:"plans"`
+	}{}
+	if err := json.Unmarshal(buffer.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	selected := decoded.Plans[0].Selected
+	if _, ok := selected[0]["addedAt"]; !ok {
+		t.Errorf("expected addedAt for a dated track")
+	}
+	if _, ok := selected[1]["addedAt"]; ok {
+		t.Errorf("expected no addedAt for an undated track")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// Recipe fields left out take the value from the command line, numbers are
+// pointers so a recipe can still set them to 0.
+type Recipe struct {
+	Name         string `json:"name"`
+	Self         string `json:"self"`
+	User         string `json:"user"`
+	Size         *int   `json:"size"`
+	Sources      string `json:"sources"`
+	Sampler      string `json:"sampler"`
+	Recency      string `json:"recency"`
+	Decay        string `json:"decay"`
+	HalfLife     string `json:"halfLife"`
+	Stratify     string `json:"stratify"`
+	YearCap      *int   `json:"yearCap"`
+	MaxPerArtist *int   `json:"maxPerArtist"`
+	MaxPerAlbum  *int   `json:"maxPerAlbum"`
+	ArtistGap    *int   `json:"artistGap"`
+	Cooldown     string `json:"cooldown"`
+	Seed         *int64 `json:"seed"`
+	Keep         *int   `json:"keep"`
+}
+
+type Recipes struct {
+	Recipes []*Recipe `json:"recipes"`
+}
+
+func LoadRecipes(path string) (recipes *Recipes, err error) {
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading recipes: %v", err)
+	}
+
+	recipes = &Recipes{}
+	err = json.Unmarshal(file, recipes)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling recipes: %v", err)
+	}
+
+	return
+}
+
+func overrideString(value *string, recipe string) {
+	if recipe != "" {
+		*value = recipe
+	}
+}
+
+func overrideInt(value *int, recipe *int) {
+	if recipe != nil {
+		*value = *recipe
+	}
+}
+
+func overrideDuration(value *time.Duration, recipe string) error {
+	if recipe == "" {
+		return nil
+	}
+
+	d, err := time.ParseDuration(recipe)
+	if err != nil {
+		return err
+	}
+
+	*value = d
+
+	return nil
+}
+
+func (r *Recipe) Options(defaults *Options) (*Options, error) {
+	if r.Name == "" {
+		return nil, fmt.Errorf("recipe missing name")
+	}
+
+	o := *defaults
+	o.Name = r.Name
+	overrideString(&o.Self, r.Self)
+	overrideString(&o.User, r.User)
+	overrideInt(&o.Size, r.Size)
+	overrideString(&o.Sources, r.Sources)
+	overrideString(&o.Sampler.Name, r.Sampler)
+	overrideString(&o.Sampler.Recency, r.Recency)
+	overrideString(&o.Sampler.Decay, r.Decay)
+	overrideString(&o.Sampler.Stratify, r.Stratify)
+	overrideInt(&o.Sampler.YearCap, r.YearCap)
+	overrideInt(&o.Constraints.MaxPerArtist, r.MaxPerArtist)
+	overrideInt(&o.Constraints.MaxPerAlbum, r.MaxPerAlbum)
+	overrideInt(&o.Constraints.MinArtistGap, r.ArtistGap)
+	overrideInt(&o.Keep, r.Keep)
+
+	if err := overrideDuration(&o.Sampler.HalfLife, r.HalfLife); err != nil {
+		return nil, fmt.Errorf("recipe '%s' half life: %v", r.Name, err)
+	}
+
+	if err := overrideDuration(&o.Cooldown, r.Cooldown); err != nil {
+		return nil, fmt.Errorf("recipe '%s' cooldown: %v", r.Name, err)
+	}
+
+	if r.Seed != nil {
+		o.Seed = *r.Seed
+	}
+
+	return &o, nil
+}
+
+func (r *Recipes) Options(defaults *Options) ([]*Options, error) {
+	all := make([]*Options, 0)
+	for _, recipe := range r.Recipes {
+		o, err := recipe.Options(defaults)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, o)
+	}
+	return all, nil
+}
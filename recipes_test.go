@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func testInt(n int) *int {
+	return &n
+}
+
+func TestRecipeOptions(t *testing.T) {
+	defaults := testOptions("")
+	defaults.Keep = 5
+	defaults.Seed = 7
+	defaults.Constraints.MaxPerArtist = 2
+
+	tests := []struct {
+		recipe       string
+		size         int
+		keep         int
+		maxPerArtist int
+		seed         int64
+	}{
+		{`{"name": "defaults"}`, 10, 5, 2, 7},
+		{`{"name": "overridden", "size": 20, "keep": 3, "maxPerArtist": 1, "seed": 9}`, 20, 3, 1, 9},
+		{`{"name": "turned off", "keep": 0, "maxPerArtist": 0, "seed": 0}`, 10, 0, 0, 0},
+	}
+
+	for _, test := range tests {
+		recipe := &Recipe{}
+		if err := json.Unmarshal([]byte(test.recipe), recipe); err != nil {
+			t.Fatal(err)
+		}
+
+		o, err := recipe.Options(defaults)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if o.Name != recipe.Name || o.Size != test.size || o.Keep != test.keep || o.Constraints.MaxPerArtist != test.maxPerArtist || o.Seed != test.seed {
+			t.Errorf("%s: unexpected options, size %d, keep %d, max per artist %d, seed %d", recipe.Name, o.Size, o.Keep, o.Constraints.MaxPerArtist, o.Seed)
+		}
+	}
+
+	if defaults.Keep != 5 || defaults.Constraints.MaxPerArtist != 2 {
+		t.Errorf("expected the defaults to be left alone")
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Budget      time.Duration
+	Stats       *RetryStats
+}
+
+type RetryStats struct {
+	lock        sync.Mutex
+	Requests    int
+	Retries     int
+	RateLimited int
+	ServerError int
+	Network     int
+	GaveUp      int
+	Waited      time.Duration
+}
+
+func (s *RetryStats) record(f func(s *RetryStats)) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	f(s)
+}
+
+func (s *RetryStats) String() string {
+	if s == nil {
+		return "no requests"
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return fmt.Sprintf("%d requests, %d retries (%d rate limited, %d server errors, %d network errors), %d gave up, waited %v",
+		s.Requests, s.Retries, s.RateLimited, s.ServerError, s.Network, s.GaveUp, s.Waited)
+}
+
+// Client wraps an existing client, usually the oauth2 one, so that retried
+// requests go through its transport again and pick up a fresh token.
+func (p *RetryPolicy) Client(client *http.Client) *http.Client {
+	if p == nil || p.MaxAttempts <= 1 {
+		return client
+	}
+
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &http.Client{
+		Transport: &RetryTransport{
+			Base:   base,
+			Policy: p,
+		},
+		CheckRedirect: client.CheckRedirect,
+		Jar:           client.Jar,
+		Timeout:       client.Timeout,
+	}
+}
+
+// Backoff is exponential in the attempt with equal jitter, so the delay is
+// somewhere between half and all of the capped exponential delay.
+func (p *RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+type RetryTransport struct {
+	Base   http.RoundTripper
+	Policy *RetryPolicy
+	lock   sync.Mutex
+	until  time.Time
+}
+
+// When spotify rate limits one request every request through the transport
+// holds off, otherwise parallel fetches keep hitting the limit.
+func (t *RetryTransport) holdUntil(until time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if until.After(t.until) {
+		t.until = until
+	}
+}
+
+func (t *RetryTransport) hold(req *http.Request) error {
+	t.lock.Lock()
+	wait := time.Until(t.until)
+	t.lock.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-req.Context().Done():
+		return req.Context().Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func retryAfter(res *http.Response) (time.Duration, bool) {
+	value := res.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if at, err := http.ParseTime(value); err == nil {
+		return time.Until(at), true
+	}
+
+	return 0, false
+}
+
+// A request that spotify never saw can always be sent again, which is the
+// case when rate limited or when no connection could be made.
+func unsent(res *http.Response, err error) bool {
+	if err != nil {
+		op, ok := err.(*net.OpError)
+		return ok && op.Op == "dial"
+	}
+	return res.StatusCode == http.StatusTooManyRequests
+}
+
+// Replacing and reordering tracks are both a PUT to the same url, only the
+// body tells them apart.
+func reordering(req *http.Request) bool {
+	if req.Body == nil {
+		return false
+	}
+	if req.GetBody == nil {
+		return true
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return true
+	}
+	defer body.Close()
+
+	fields := make(map[string]json.RawMessage)
+	if err := json.NewDecoder(body).Decode(&fields); err != nil {
+		return true
+	}
+
+	_, ok := fields["range_start"]
+	return ok
+}
+
+// Adding tracks, creating playlists and reordering aren't idempotent. After
+// a 5xx or a broken connection they may still have been applied, so they're
+// only retried when spotify never saw them.
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodPost:
+		return false
+	case http.MethodPut:
+		return !reordering(req)
+	}
+	return true
+}
+
+func retryable(req *http.Request, res *http.Response, err error) bool {
+	if unsent(res, err) {
+		return true
+	}
+
+	if err != nil {
+		_, ok := err.(net.Error)
+		return ok && idempotent(req)
+	}
+
+	switch res.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return idempotent(req)
+	}
+
+	return false
+}
+
+func discard(res *http.Response) {
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+}
+
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	p := t.Policy
+	started := time.Now()
+
+	p.Stats.record(func(s *RetryStats) {
+		s.Requests += 1
+	})
+
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 && req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("error retrying request: %v", err)
+			}
+			req = req.WithContext(req.Context())
+			req.Body = body
+		}
+
+		if err := t.hold(req); err != nil {
+			return nil, err
+		}
+
+		res, err := t.Base.RoundTrip(req)
+		if !retryable(req, res, err) {
+			return res, err
+		}
+
+		delay := p.Backoff(attempt)
+		if err == nil {
+			if after, ok := retryAfter(res); ok {
+				t.holdUntil(time.Now().Add(after))
+				if after > delay {
+					delay = after
+				}
+			}
+		}
+
+		exhausted := attempt >= p.MaxAttempts || (req.Body != nil && req.GetBody == nil)
+		if p.Budget > 0 && time.Since(started)+delay > p.Budget {
+			exhausted = true
+		}
+
+		if exhausted {
+			p.Stats.record(func(s *RetryStats) {
+				s.GaveUp += 1
+			})
+			log.Printf("spotify: giving up on %s %s after %d attempts", req.Method, req.URL.Path, attempt)
+			return res, err
+		}
+
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = res.Status
+			discard(res)
+		}
+
+		p.Stats.record(func(s *RetryStats) {
+			s.Retries += 1
+			s.Waited += delay
+			switch {
+			case err != nil:
+				s.Network += 1
+			case res.StatusCode == http.StatusTooManyRequests:
+				s.RateLimited += 1
+			default:
+				s.ServerError += 1
+			}
+		})
+
+		log.Printf("spotify: %s %s: %s, retrying in %v (%d/%d)", req.Method, req.URL.Path, reason, delay, attempt, p.MaxAttempts)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+var (
+	refused = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	reset   = &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+	timeout = &timeoutError{}
+)
+
+type scriptedStep struct {
+	status int
+	err    error
+}
+
+// scriptedTransport answers each attempt with the next step of its script,
+// then with 200s, and keeps the bodies it was sent.
+type scriptedTransport struct {
+	script []scriptedStep
+	bodies []string
+}
+
+func (t *scriptedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := ""
+	if req.Body != nil {
+		data, _ := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		body = string(data)
+	}
+	t.bodies = append(t.bodies, body)
+
+	step := scriptedStep{status: http.StatusOK}
+	if len(t.script) > 0 {
+		step, t.script = t.script[0], t.script[1:]
+	}
+	if step.err != nil {
+		return nil, step.err
+	}
+
+	return &http.Response{
+		StatusCode: step.status,
+		Status:     http.StatusText(step.status),
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+func TestRetryPolicy(t *testing.T) {
+	const (
+		replace = `{"uris":["spotify:track:a"]}`
+		reorder = `{"range_start":3,"insert_before":0}`
+	)
+
+	tests := []struct {
+		name     string
+		method   string
+		body     string
+		script   []scriptedStep
+		attempts int
+		status   int
+		fails    bool
+	}{
+		{"get retries 5xx", "GET", "", []scriptedStep{{status: 503}, {status: 502}}, 3, 200, false},
+		{"get retries timeouts", "GET", "", []scriptedStep{{err: timeout}}, 2, 200, false},
+		{"get retries resets", "GET", "", []scriptedStep{{err: reset}}, 2, 200, false},
+		{"get gives up", "GET", "", []scriptedStep{{status: 500}, {status: 500}, {status: 500}}, 3, 500, false},
+		{"get doesn't retry 4xx", "GET", "", []scriptedStep{{status: 404}}, 1, 404, false},
+		{"delete retries 5xx", "DELETE", replace, []scriptedStep{{status: 503}}, 2, 200, false},
+		{"post retries 429", "POST", replace, []scriptedStep{{status: 429}}, 2, 200, false},
+		{"post retries refused", "POST", replace, []scriptedStep{{err: refused}}, 2, 200, false},
+		{"post doesn't retry 5xx", "POST", replace, []scriptedStep{{status: 503}}, 1, 503, false},
+		{"post doesn't retry resets", "POST", replace, []scriptedStep{{err: reset}}, 1, 0, true},
+		{"post doesn't retry timeouts", "POST", replace, []scriptedStep{{err: timeout}}, 1, 0, true},
+		{"replace retries 5xx", "PUT", replace, []scriptedStep{{status: 503}}, 2, 200, false},
+		{"replace retries resets", "PUT", replace, []scriptedStep{{err: reset}}, 2, 200, false},
+		{"reorder retries 429", "PUT", reorder, []scriptedStep{{status: 429}}, 2, 200, false},
+		{"reorder retries refused", "PUT", reorder, []scriptedStep{{err: refused}}, 2, 200, false},
+		{"reorder doesn't retry 5xx", "PUT", reorder, []scriptedStep{{status: 502}}, 1, 502, false},
+		{"reorder doesn't retry resets", "PUT", reorder, []scriptedStep{{err: reset}}, 1, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scripted := &scriptedTransport{script: test.script}
+			client := testRetryPolicy().Client(&http.Client{Transport: scripted})
+
+			var body *bytes.Reader
+			req, _ := http.NewRequest(test.method, "https://api.spotify.com/v1/playlists/pl/tracks", nil)
+			if test.body != "" {
+				body = bytes.NewReader([]byte(test.body))
+				req, _ = http.NewRequest(test.method, "https://api.spotify.com/v1/playlists/pl/tracks", body)
+			}
+
+			res, err := client.Do(req)
+			if test.fails {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				res.Body.Close()
+				if res.StatusCode != test.status {
+					t.Errorf("expected %d, got %d", test.status, res.StatusCode)
+				}
+			}
+
+			if len(scripted.bodies) != test.attempts {
+				t.Errorf("expected %d attempts, got %d", test.attempts, len(scripted.bodies))
+			}
+			for _, sent := range scripted.bodies {
+				if sent != test.body {
+					t.Errorf("expected every attempt to send %q, got %q", test.body, sent)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := &RetryPolicy{
+		BaseDelay: 100 * time.Millisecond,
+		MaxDelay:  time.Second,
+	}
+
+	tests := []struct {
+		attempt int
+		min     time.Duration
+		max     time.Duration
+	}{
+		{1, 50 * time.Millisecond, 100 * time.Millisecond},
+		{2, 100 * time.Millisecond, 200 * time.Millisecond},
+		{3, 200 * time.Millisecond, 400 * time.Millisecond},
+		{4, 400 * time.Millisecond, 800 * time.Millisecond},
+		{5, 500 * time.Millisecond, time.Second},
+		{30, 500 * time.Millisecond, time.Second},
+	}
+
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			if delay := p.Backoff(test.attempt); delay < test.min || delay > test.max {
+				t.Fatalf("attempt %d: expected between %v and %v, got %v", test.attempt, test.min, test.max, delay)
+			}
+		}
+	}
+
+	if delay := (&RetryPolicy{}).Backoff(3); delay != 0 {
+		t.Errorf("expected no delay without a base delay, got %v", delay)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		value    string
+		ok       bool
+		expected time.Duration
+	}{
+		{"", false, 0},
+		{"3", true, 3 * time.Second},
+		{"soon", false, 0},
+		{time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat), true, 10 * time.Second},
+	}
+
+	for _, test := range tests {
+		res := &http.Response{Header: make(http.Header)}
+		if test.value != "" {
+			res.Header.Set("Retry-After", test.value)
+		}
+
+		after, ok := retryAfter(res)
+		if ok != test.ok {
+			t.Errorf("%q: expected ok %v", test.value, test.ok)
+		}
+		if after > test.expected || after < test.expected-2*time.Second {
+			t.Errorf("%q: expected %v, got %v", test.value, test.expected, after)
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	scripted := &scriptedTransport{script: []scriptedStep{{status: 503}, {status: 503}}}
+	policy := &RetryPolicy{
+		MaxAttempts: 5,
+		BaseDelay:   50 * time.Millisecond,
+		MaxDelay:    50 * time.Millisecond,
+		Budget:      10 * time.Millisecond,
+		Stats:       &RetryStats{},
+	}
+
+	res, err := policy.Client(&http.Client{Transport: scripted}).Get("https://api.spotify.com/v1/me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusServiceUnavailable || len(scripted.bodies) != 1 || policy.Stats.GaveUp != 1 {
+		t.Errorf("expected to give up once the budget is spent, got %d after %d attempts", res.StatusCode, len(scripted.bodies))
+	}
+}
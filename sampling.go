@@ -0,0 +1,376 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/zmb3/spotify"
+)
+
+type Candidate struct {
+	ID      spotify.ID
+	Track   spotify.PlaylistTrack
+	AddedAt time.Time
+	Sources []Playlist
+}
+
+type CandidatePool struct {
+	Candidates []*Candidate
+	byID       map[spotify.ID]*Candidate
+}
+
+func NewCandidatePool() *CandidatePool {
+	return &CandidatePool{
+		Candidates: make([]*Candidate, 0),
+		byID:       make(map[spotify.ID]*Candidate),
+	}
+}
+
+func (cp *CandidatePool) Add(pl Playlist, tracks []spotify.PlaylistTrack) {
+	for _, t := range tracks {
+		id := t.Track.ID
+		if len(id) == 0 {
+			continue
+		}
+
+		addedAt, err := ParseAddedAt(t.AddedAt)
+		if err != nil {
+			log.Printf("warning: %v", err)
+		}
+
+		if c, ok := cp.byID[id]; ok {
+			c.Sources = append(c.Sources, pl)
+			if !addedAt.IsZero() && (c.AddedAt.IsZero() || addedAt.Before(c.AddedAt)) {
+				c.AddedAt = addedAt
+			}
+			continue
+		}
+
+		c := &Candidate{
+			ID:      id,
+			Track:   t,
+			AddedAt: addedAt,
+			Sources: []Playlist{pl},
+		}
+		cp.byID[id] = c
+		cp.Candidates = append(cp.Candidates, c)
+	}
+}
+
+func (cp *CandidatePool) Remove(removing *TracksSet) (np *CandidatePool) {
+	np = NewCandidatePool()
+	for _, c := range cp.Candidates {
+		if !removing.Contains(c.ID) {
+			np.byID[c.ID] = c
+			np.Candidates = append(np.Candidates, c)
+		}
+	}
+	return
+}
+
+func (cp *CandidatePool) Get(id spotify.ID) *Candidate {
+	return cp.byID[id]
+}
+
+func (cp *CandidatePool) Len() int {
+	return len(cp.Candidates)
+}
+
+type Sampler interface {
+	Sample(pool *CandidatePool, number int) (*TracksSet, error)
+}
+
+type SamplerOptions struct {
+	Name     string
+	Recency  string
+	Decay    string
+	HalfLife time.Duration
+	Stratify string
+	YearCap  int
+}
+
+func NewSampler(options *SamplerOptions, now time.Time, rng *rand.Rand) (Sampler, error) {
+	switch options.Name {
+	case "", "uniform":
+		return &UniformSampler{rng: rng}, nil
+	case "weighted":
+		return &WeightedSampler{Weight: WeightBySources, rng: rng}, nil
+	case "recency":
+		weight, err := WeightByRecency(now, options.Recency, options.Decay, options.HalfLife)
+		if err != nil {
+			return nil, err
+		}
+		return &WeightedSampler{Weight: weight, rng: rng}, nil
+	case "stratified":
+		return &StratifiedSampler{Allocation: options.Stratify, YearCap: options.YearCap, rng: rng}, nil
+	case "diverse":
+		return &DiverseSampler{Inner: &UniformSampler{rng: rng}}, nil
+	}
+	return nil, fmt.Errorf("unknown sampler: %v", options.Name)
+}
+
+func takeSample(ordered []*Candidate, number int) *TracksSet {
+	if len(ordered) < number {
+		log.Printf("warning: only %d tracks to sample from, wanted %d", len(ordered), number)
+		number = len(ordered)
+	}
+
+	selected := NewEmptyTracksSet()
+	for _, c := range ordered[:number] {
+		selected.Add(c.ID)
+	}
+	return selected
+}
+
+type UniformSampler struct {
+	rng *rand.Rand
+}
+
+func (s *UniformSampler) Sample(pool *CandidatePool, number int) (*TracksSet, error) {
+	ordered := make([]*Candidate, pool.Len())
+	for i, j := range s.rng.Perm(pool.Len()) {
+		ordered[i] = pool.Candidates[j]
+	}
+
+	return takeSample(ordered, number), nil
+}
+
+type WeightedSampler struct {
+	Weight func(c *Candidate) float64
+	rng    *rand.Rand
+}
+
+func WeightBySources(c *Candidate) float64 {
+	return float64(len(c.Sources))
+}
+
+const minimumRecencyWeight = 0.001
+
+func WeightByRecency(now time.Time, favour, curve string, halfLife time.Duration) (func(c *Candidate) float64, error) {
+	if halfLife <= 0 {
+		return nil, fmt.Errorf("half life must be positive: %v", halfLife)
+	}
+
+	var decay func(age time.Duration) float64
+	switch curve {
+	case "", "exponential":
+		decay = func(age time.Duration) float64 {
+			return math.Pow(0.5, float64(age)/float64(halfLife))
+		}
+	case "linear":
+		decay = func(age time.Duration) float64 {
+			return math.Max(0, 1-float64(age)/float64(2*halfLife))
+		}
+	default:
+		return nil, fmt.Errorf("unknown decay curve: %v", curve)
+	}
+
+	var older bool
+	switch favour {
+	case "", "old":
+		older = true
+	case "recent":
+		older = false
+	default:
+		return nil, fmt.Errorf("unknown recency: %v", favour)
+	}
+
+	return func(c *Candidate) float64 {
+		if c.AddedAt.IsZero() {
+			return minimumRecencyWeight
+		}
+
+		age := now.Sub(c.AddedAt)
+		if age < 0 {
+			age = 0
+		}
+
+		w := decay(age)
+		if older {
+			w = 1 - w
+		}
+
+		return math.Max(w, minimumRecencyWeight)
+	}, nil
+}
+
+type keyedCandidate struct {
+	candidate *Candidate
+	key       float64
+}
+
+func (s *WeightedSampler) Sample(pool *CandidatePool, number int) (*TracksSet, error) {
+	keyed := make([]keyedCandidate, 0, pool.Len())
+	for _, c := range pool.Candidates {
+		w := s.Weight(c)
+		if w <= 0 {
+			continue
+		}
+
+		// Efraimidis-Spirakis, the largest u^(1/w) keys form a weighted
+		// sample without replacement. Compared as log(u)/w because u^(1/w)
+		// underflows to 0 for small weights, leaving them in pool order.
+		keyed = append(keyed, keyedCandidate{
+			candidate: c,
+			key:       math.Log(s.rng.Float64()) / w,
+		})
+	}
+
+	sort.SliceStable(keyed, func(i, j int) bool {
+		return keyed[i].key > keyed[j].key
+	})
+
+	ordered := make([]*Candidate, 0, len(keyed))
+	for _, k := range keyed {
+		ordered = append(ordered, k.candidate)
+	}
+
+	return takeSample(ordered, number), nil
+}
+
+type StratifiedSampler struct {
+	Allocation string
+	YearCap    int
+	rng        *rand.Rand
+}
+
+type stratum struct {
+	named     bool
+	year      int
+	size      int
+	taken     int
+	remaining []*Candidate
+}
+
+func (st *stratum) next(seen map[spotify.ID]bool) *Candidate {
+	for len(st.remaining) > 0 {
+		c := st.remaining[0]
+		st.remaining = st.remaining[1:]
+		if !seen[c.ID] {
+			return c
+		}
+	}
+	return nil
+}
+
+func (s *StratifiedSampler) Sample(pool *CandidatePool, number int) (*TracksSet, error) {
+	if s.Allocation != "" && s.Allocation != "equal" && s.Allocation != "proportional" {
+		return nil, fmt.Errorf("unknown stratified allocation: %v", s.Allocation)
+	}
+
+	byID := make(map[spotify.ID]*stratum)
+	strata := make([]*stratum, 0)
+	for _, c := range pool.Candidates {
+		for _, source := range c.Sources {
+			st, ok := byID[source.ID]
+			if !ok {
+				st = &stratum{}
+				if pm, ok := ParseMonthlyName(source.Name); ok && pm.HasYear() {
+					st.named = true
+					st.year = pm.Year
+				}
+				byID[source.ID] = st
+				strata = append(strata, st)
+			}
+			st.remaining = append(st.remaining, c)
+			st.size += 1
+			if !st.named && c.AddedAt.Year() > st.year {
+				st.year = c.AddedAt.Year()
+			}
+		}
+	}
+
+	for _, st := range strata {
+		s.rng.Shuffle(len(st.remaining), func(i, j int) {
+			st.remaining[i], st.remaining[j] = st.remaining[j], st.remaining[i]
+		})
+	}
+
+	s.rng.Shuffle(len(strata), func(i, j int) {
+		strata[i], strata[j] = strata[j], strata[i]
+	})
+
+	less := func(a, b *stratum) bool {
+		return a.taken < b.taken
+	}
+	if s.Allocation == "proportional" {
+		// Sainte-Lague, the next track goes to the stratum with the highest
+		// size / (2 * taken + 1) quotient.
+		less = func(a, b *stratum) bool {
+			return (2*a.taken+1)*b.size < (2*b.taken+1)*a.size
+		}
+	}
+
+	years := make(map[int]int)
+	seen := make(map[spotify.ID]bool)
+	ordered := make([]*Candidate, 0, number)
+	for len(ordered) < number {
+		var best *stratum
+		for _, st := range strata {
+			if len(st.remaining) == 0 {
+				continue
+			}
+			if s.YearCap > 0 && years[st.year] >= s.YearCap {
+				continue
+			}
+			if best == nil || less(st, best) {
+				best = st
+			}
+		}
+
+		if best == nil {
+			break
+		}
+
+		c := best.next(seen)
+		if c == nil {
+			continue
+		}
+
+		seen[c.ID] = true
+		best.taken += 1
+		years[best.year] += 1
+		ordered = append(ordered, c)
+	}
+
+	return takeSample(ordered, number), nil
+}
+
+type DiverseSampler struct {
+	Inner Sampler
+}
+
+func (s *DiverseSampler) Sample(pool *CandidatePool, number int) (*TracksSet, error) {
+	everything, err := s.Inner.Sample(pool, pool.Len())
+	if err != nil {
+		return nil, err
+	}
+
+	artists := make(map[spotify.ID]bool)
+	preferred := make([]*Candidate, 0)
+	deferred := make([]*Candidate, 0)
+	for _, id := range everything.ToArray() {
+		c := pool.Get(id)
+		fresh := true
+		for _, a := range c.Track.Track.Artists {
+			if artists[a.ID] {
+				fresh = false
+			}
+		}
+
+		if fresh {
+			for _, a := range c.Track.Track.Artists {
+				artists[a.ID] = true
+			}
+			preferred = append(preferred, c)
+		} else {
+			deferred = append(deferred, c)
+		}
+	}
+
+	return takeSample(append(preferred, deferred...), number), nil
+}
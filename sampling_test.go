@@ -0,0 +1,155 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zmb3/spotify"
+)
+
+type testSource struct {
+	name    string
+	prefix  string
+	tracks  int
+	addedAt time.Time
+}
+
+func testPool(sources ...testSource) *CandidatePool {
+	pool := NewCandidatePool()
+	for _, s := range sources {
+		pool.Add(Playlist{ID: spotify.ID(s.name), Name: s.name}, testTracks(s.prefix, s.tracks, s.addedAt))
+	}
+	return pool
+}
+
+func countByPrefix(selected *TracksSet) map[string]int {
+	counts := make(map[string]int)
+	for _, id := range selected.ToArray() {
+		counts[strings.TrimRight(string(id), "0123456789")] += 1
+	}
+	return counts
+}
+
+func TestStratifiedSampler(t *testing.T) {
+	older := time.Date(2017, time.July, 1, 0, 0, 0, 0, time.UTC)
+
+	// Expected counts are keyed by the sources they're from, together.
+	tests := []struct {
+		name       string
+		allocation string
+		yearCap    int
+		sources    []testSource
+		number     int
+		expected   map[string]int
+	}{
+		{
+			name:       "equal",
+			allocation: "equal",
+			sources:    []testSource{{"January 2019", "a", 20, testEpoch}, {"February 2019", "b", 10, testEpoch}},
+			number:     10,
+			expected:   map[string]int{"a": 5, "b": 5},
+		},
+		{
+			name:       "equal tops up from larger strata",
+			allocation: "",
+			sources:    []testSource{{"January 2019", "a", 20, testEpoch}, {"February 2019", "b", 2, testEpoch}},
+			number:     10,
+			expected:   map[string]int{"a": 8, "b": 2},
+		},
+		{
+			name:       "proportional",
+			allocation: "proportional",
+			sources:    []testSource{{"January 2019", "a", 20, testEpoch}, {"February 2019", "b", 10, testEpoch}},
+			number:     10,
+			expected:   map[string]int{"a": 7, "b": 3},
+		},
+		{
+			name:       "year cap",
+			allocation: "equal",
+			yearCap:    3,
+			sources:    []testSource{{"January 2019", "a", 10, testEpoch}, {"February 2019", "b", 10, testEpoch}, {"March 2018", "c", 10, testEpoch}},
+			number:     10,
+			expected:   map[string]int{"ab": 3, "c": 3},
+		},
+		{
+			name:       "year cap by added at without a year in the name",
+			allocation: "equal",
+			yearCap:    4,
+			sources:    []testSource{{"January 2017", "a", 10, testEpoch}, {"Summer", "b", 10, older}},
+			number:     10,
+			expected:   map[string]int{"ab": 4},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sampler := &StratifiedSampler{Allocation: test.allocation, YearCap: test.yearCap, rng: rand.New(rand.NewSource(1))}
+
+			selected, err := sampler.Sample(testPool(test.sources...), test.number)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			counts := countByPrefix(selected)
+			for prefixes, expected := range test.expected {
+				actual := 0
+				for _, prefix := range prefixes {
+					actual += counts[string(prefix)]
+				}
+				if actual != expected {
+					t.Errorf("expected %d from %s, got %v", expected, prefixes, counts)
+				}
+			}
+		})
+	}
+}
+
+func TestStratifiedSamplerSharedTracks(t *testing.T) {
+	pool := testPool(testSource{"January 2019", "a", 6, testEpoch}, testSource{"February 2019", "a", 6, testEpoch})
+
+	sampler := &StratifiedSampler{Allocation: "equal", rng: rand.New(rand.NewSource(1))}
+	selected, err := sampler.Sample(pool, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected.Ordered) != 6 || len(selected.Ids) != 6 {
+		t.Errorf("expected each track once, got %v", selected.Ordered)
+	}
+
+	sampler.Allocation = "random"
+	if _, err := sampler.Sample(pool, 10); err == nil {
+		t.Errorf("expected unknown allocations to fail")
+	}
+}
+
+func TestWeightedSamplerSmallWeights(t *testing.T) {
+	pool := testPool(testSource{"January 2019", "a", 100, time.Time{}})
+
+	// All at the minimum weight, where u^(1/w) is 0 about half the time, so
+	// ties would be taken in pool order and only later tracks left out.
+	first := make(map[spotify.ID]bool)
+	for _, c := range pool.Candidates[:50] {
+		first[c.ID] = true
+	}
+
+	for seed := int64(0); seed < 5; seed++ {
+		sampler := &WeightedSampler{Weight: func(c *Candidate) float64 { return minimumRecencyWeight }, rng: rand.New(rand.NewSource(seed))}
+
+		selected, err := sampler.Sample(pool, 80)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		left := len(first)
+		for _, id := range selected.ToArray() {
+			if first[id] {
+				left -= 1
+			}
+		}
+		if left < 3 {
+			t.Errorf("seed %d: expected an even sample, left out %d of the first 50", seed, left)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zmb3/spotify"
+)
+
+// Selectors are written as comma separated terms, for example
+// "monthly,glob:summer *,exclude:*mix*,owned,min-tracks:10". A playlist is
+// selected when it matches any of monthly, name, glob or id (or there are
+// none of those) and every one of the remaining filters. The date filters
+// from:2017, to:2019-06, same-month and older-than:2y only ever match
+// monthly playlists.
+type Selector struct {
+	Monthly    bool
+	Names      []*regexp.Regexp
+	Globs      []string
+	IDs        []spotify.ID
+	Owners     []string
+	Excludes   []string
+	ExcludeIDs []spotify.ID
+	Ownership  string
+	MinTracks  int
+	From       *PlaylistMonth
+	To         *PlaylistMonth
+	SameMonth  bool
+	OlderThan  int
+	Now        time.Time
+}
+
+func ParseSelector(value string) (*Selector, error) {
+	s := &Selector{
+		Now: time.Now(),
+	}
+
+	for _, term := range strings.Split(value, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+
+		key, arg := term, ""
+		if i := strings.Index(term, ":"); i >= 0 {
+			key, arg = term[:i], term[i+1:]
+		}
+
+		switch key {
+		case "name", "glob", "id", "owner", "exclude", "exclude-id", "min-tracks", "from", "to", "older-than":
+			if arg == "" {
+				return nil, fmt.Errorf("selector term missing argument: %v", term)
+			}
+		}
+
+		switch key {
+		case "all":
+		case "monthly":
+			s.Monthly = true
+		case "owned", "followed":
+			s.Ownership = key
+		case "name":
+			re, err := regexp.Compile(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid selector name '%s': %v", arg, err)
+			}
+			s.Names = append(s.Names, re)
+		case "glob":
+			s.Globs = append(s.Globs, strings.ToLower(arg))
+		case "id":
+			s.IDs = append(s.IDs, spotify.ID(arg))
+		case "owner":
+			s.Owners = append(s.Owners, arg)
+		case "exclude":
+			s.Excludes = append(s.Excludes, strings.ToLower(arg))
+		case "exclude-id":
+			s.ExcludeIDs = append(s.ExcludeIDs, spotify.ID(arg))
+		case "min-tracks":
+			n, err := strconv.Atoi(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid selector min-tracks '%s': %v", arg, err)
+			}
+			s.MinTracks = n
+		case "from", "to":
+			pm, err := ParseYearMonth(arg, key == "to")
+			if err != nil {
+				return nil, fmt.Errorf("invalid selector %s: %v", key, err)
+			}
+			if key == "from" {
+				s.From = &pm
+			} else {
+				s.To = &pm
+			}
+		case "same-month":
+			s.SameMonth = true
+		case "older-than":
+			n, err := ParseMonths(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid selector older-than: %v", err)
+			}
+			s.OlderThan = n
+		default:
+			return nil, fmt.Errorf("unknown selector term: %v", term)
+		}
+	}
+
+	return s, nil
+}
+
+func globMatch(pattern, name string) bool {
+	matched, err := filepath.Match(pattern, strings.ToLower(name))
+	return err == nil && matched
+}
+
+func containsId(ids []spotify.ID, id spotify.ID) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Selector) includes(pl Playlist, monthly bool) bool {
+	if !s.Monthly && len(s.Names) == 0 && len(s.Globs) == 0 && len(s.IDs) == 0 {
+		return true
+	}
+
+	if s.Monthly && monthly {
+		return true
+	}
+
+	for _, re := range s.Names {
+		if re.MatchString(pl.Name) {
+			return true
+		}
+	}
+
+	for _, glob := range s.Globs {
+		if globMatch(glob, pl.Name) {
+			return true
+		}
+	}
+
+	return containsId(s.IDs, pl.ID)
+}
+
+func (s *Selector) excludes(pl Playlist) bool {
+	if containsId(s.ExcludeIDs, pl.ID) {
+		return true
+	}
+
+	for _, glob := range s.Excludes {
+		if globMatch(glob, pl.Name) {
+			return true
+		}
+	}
+
+	if len(s.Owners) > 0 {
+		owned := false
+		for _, owner := range s.Owners {
+			if strings.EqualFold(owner, pl.Owner) {
+				owned = true
+			}
+		}
+		if !owned {
+			return true
+		}
+	}
+
+	subscribed := pl.Owner != pl.User
+	switch s.Ownership {
+	case "owned":
+		return subscribed
+	case "followed":
+		return !subscribed
+	}
+
+	return false
+}
+
+func (s *Selector) dated() bool {
+	return s.From != nil || s.To != nil || s.SameMonth || s.OlderThan > 0
+}
+
+func (s *Selector) inRange(pm PlaylistMonth) bool {
+	now := PlaylistMonth{Year: s.Now.Year(), Month: s.Now.Month()}
+
+	if s.From != nil && pm.Before(*s.From) {
+		return false
+	}
+	if s.To != nil && s.To.Before(pm) {
+		return false
+	}
+	if s.SameMonth && (pm.Month != now.Month || pm.Year >= now.Year) {
+		return false
+	}
+	if s.OlderThan > 0 && MonthsBetween(pm, now) < s.OlderThan {
+		return false
+	}
+
+	return true
+}
+
+func (s *Selector) Select(playlists *PlaylistSet, getTracks func(pl Playlist) ([]spotify.PlaylistTrack, error)) (*PlaylistSet, error) {
+	monthly := make(map[spotify.ID]bool)
+	for _, pl := range playlists.Monthly().Playlists {
+		monthly[pl.ID] = true
+	}
+
+	selected := make([]Playlist, 0)
+	for _, pl := range playlists.Playlists {
+		if !s.includes(pl, monthly[pl.ID]) || s.excludes(pl) {
+			continue
+		}
+
+		if s.MinTracks > 0 || s.dated() {
+			tracks, err := getTracks(pl)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(tracks) < s.MinTracks {
+				continue
+			}
+
+			if s.dated() {
+				pm, ok := ResolvePlaylistMonth(pl, tracks)
+				if !ok || !pm.HasYear() || !s.inRange(pm) {
+					continue
+				}
+			}
+		}
+
+		selected = append(selected, pl)
+	}
+
+	return &PlaylistSet{
+		Playlists: selected,
+	}, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zmb3/spotify"
+)
+
+type testSelectable struct {
+	id      string
+	name    string
+	owner   string
+	tracks  int
+	addedAt time.Time
+}
+
+func testSelect(t *testing.T, value string, now time.Time, playlists ...testSelectable) string {
+	selector, err := ParseSelector(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selector.Now = now
+
+	set := &PlaylistSet{}
+	tracks := make(map[spotify.ID][]spotify.PlaylistTrack)
+	for _, pl := range playlists {
+		set.Playlists = append(set.Playlists, Playlist{ID: spotify.ID(pl.id), Name: pl.name, Owner: pl.owner, User: "tester"})
+		tracks[spotify.ID(pl.id)] = testTracks(pl.id, pl.tracks, pl.addedAt)
+	}
+
+	selected, err := selector.Select(set, func(pl Playlist) ([]spotify.PlaylistTrack, error) {
+		return tracks[pl.ID], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make([]string, 0)
+	for _, pl := range selected.Playlists {
+		ids = append(ids, string(pl.ID))
+	}
+	return strings.Join(ids, " ")
+}
+
+func TestSelectorTerms(t *testing.T) {
+	playlists := []testSelectable{
+		{"jan", "January 2019", "tester", 3, testEpoch},
+		{"dec", "2018 December", "tester", 2, testEpoch},
+		{"summer", "Summer Jams", "tester", 3, testEpoch},
+		{"mix", "Summer mix", "other", 0, testEpoch},
+	}
+
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"", "jan dec summer mix"},
+		{"all", "jan dec summer mix"},
+		{"monthly", "jan dec"},
+		{"name:^Summer", "summer mix"},
+		{"name:mix$", "mix"},
+		{"glob:summer *", "summer mix"},
+		{"id:jan,id:mix", "jan mix"},
+		{"monthly,name:Jams", "jan dec summer"},
+		{"exclude:*mix*", "jan dec summer"},
+		{"monthly,exclude:2018 *", "jan"},
+		{"exclude-id:summer", "jan dec mix"},
+		{"owner:OTHER", "mix"},
+		{"owned", "jan dec summer"},
+		{"followed", "mix"},
+		{"min-tracks:3", "jan summer"},
+		{"glob:summer*,owned,min-tracks:1", "summer"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			if actual := testSelect(t, test.value, testEpoch, playlists...); actual != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestParseSelectorErrors(t *testing.T) {
+	for _, value := range []string{"name:", "glob", "id:", "owner", "exclude:", "exclude-id", "min-tracks:", "min-tracks:many", "name:[", "bogus", "monthly,newest"} {
+		t.Run(value, func(t *testing.T) {
+			if _, err := ParseSelector(value); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestSelectorDateRanges(t *testing.T) {
+	now := time.Date(2019, time.June, 15, 0, 0, 0, 0, time.UTC)
+	older := time.Date(2017, time.May, 10, 0, 0, 0, 0, time.UTC)
+
+	playlists := []testSelectable{
+		{"jun19", "June 2019", "tester", 1, now},
+		{"jan19", "January 2019", "tester", 1, now},
+		{"dec18", "2018 December", "tester", 1, now},
+		{"jun18", "June 2018", "tester", 1, now},
+		{"may", "May", "tester", 1, older},
+		{"summer", "Summer 2018", "tester", 1, now},
+	}
+
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"from:2019", "jun19 jan19"},
+		{"from:2019-01", "jun19 jan19"},
+		{"from:2019-02", "jun19"},
+		{"to:2018", "dec18 jun18 may"},
+		{"to:2018-11", "jun18 may"},
+		{"from:2018-12,to:2019-01", "jan19 dec18"},
+		{"from:2018-06,to:2018-06", "jun18"},
+		{"same-month", "jun18"},
+		{"older-than:1y", "jun18 may"},
+		{"older-than:6m", "dec18 jun18 may"},
+		{"older-than:7m", "jun18 may"},
+		{"glob:summer*,to:2019", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			if actual := testSelect(t, test.value, now, playlists...); actual != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, actual)
+			}
+		})
+	}
+
+	for _, value := range []string{"from:", "from:2019-13", "to:soon", "older-than:2w", "older-than:y"} {
+		if _, err := ParseSelector(value); err == nil {
+			t.Errorf("%s: expected an error", value)
+		}
+	}
+}
@@ -8,7 +8,10 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/zmb3/spotify"
@@ -30,17 +33,66 @@ func sendFile(w http.ResponseWriter, path string) error {
 }
 
 type Services struct {
+	lock    sync.Mutex
+	options *Options
+	client  MusicService
 	spotify *SpotifyCacher
 	user    string
+	state   *StateDirectory
+}
+
+func NewServices(options *Options, spotifyClient MusicService) *Services {
+	return &Services{
+		options: options,
+		client:  spotifyClient,
+		user:    options.User,
+		state:   &options.State,
+	}
+}
+
+// open locks and opens the cache for a single request, one request at a
+// time, so the lock is only held while serving and the generator can use the
+// cache in between. The storage is reopened too because bolt won't share its
+// file with another process.
+func (s *Services) open(h func() error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	cacher, closeCache, err := OpenSpotifyCacher(s.options, s.client)
+	if err != nil {
+		return err
+	}
+
+	s.spotify = cacher
+
+	defer func() {
+		s.spotify = nil
+		if err := closeCache(); err != nil {
+			log.Printf("%v", err)
+		}
+	}()
+
+	return h()
 }
 
 func getPlaylists(ctx context.Context, s *Services, w http.ResponseWriter, r *http.Request) error {
-	return sendFile(w, ".cache/playlists.json")
+	return sendFile(w, s.state.Summaries())
 }
 
 func getPlaylist(ctx context.Context, s *Services, w http.ResponseWriter, r *http.Request) error {
 	playlistId := mux.Vars(r)["id"]
-	return sendFile(w, fmt.Sprintf(".cache/playlist-%s.json", playlistId))
+
+	data, err := s.spotify.storage.Get(fmt.Sprintf("playlist-%s", playlistId))
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return fmt.Errorf("no such playlist: %v", playlistId)
+	}
+
+	_, err = w.Write(data)
+
+	return err
 }
 
 type PlaylistIDAndName struct {
@@ -104,12 +156,13 @@ func searchPlaylists(ctx context.Context, s *Services, w http.ResponseWriter, r
 		return err
 	}
 
+	all, err := s.spotify.GetPlaylistsTracks(s.user, playlists.Playlists)
+	if err != nil {
+		return err
+	}
+
 	for _, pl := range playlists.Playlists {
-		playlistTracks, err := s.spotify.GetPlaylistTracks(s.user, pl.ID)
-		if err != nil {
-			return err
-		}
-		for _, track := range playlistTracks {
+		for _, track := range all[pl.ID] {
 			if strings.Contains(strings.ToLower(track.Track.Name), q) {
 				id := track.Track.ID.String()
 
@@ -158,8 +211,9 @@ func searchPlaylists(ctx context.Context, s *Services, w http.ResponseWriter, r
 
 func middleware(services *Services, h func(context.Context, *Services, http.ResponseWriter, *http.Request) error) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-		err := h(ctx, services, w, r)
+		err := services.open(func() error {
+			return h(r.Context(), services, w, r)
+		})
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			io.WriteString(w, fmt.Sprintf("error: %v", err))
@@ -167,24 +221,41 @@ func middleware(services *Services, h func(context.Context, *Services, http.Resp
 	}
 }
 
-func Serve(options *Options) error {
-	spotifyClient, _ := AuthenticateSpotify()
-	cacher := NewSpotifyCacher(spotifyClient, false)
-
-	services := &Services{
-		spotify: cacher,
-		user:    options.User,
-	}
-
+func NewRouter(services *Services) *mux.Router {
 	router := mux.NewRouter().StrictSlash(true)
 
 	router.HandleFunc("/playlists", middleware(services, getPlaylists)).Methods("GET")
 	router.HandleFunc("/playlists/{id}", middleware(services, getPlaylist)).Methods("GET")
 	router.HandleFunc("/search", middleware(services, searchPlaylists)).Methods("GET")
 
+	return router
+}
+
+func Serve(options *Options) error {
+	spotifyClient, err := connect(options)
+	if err != nil {
+		return err
+	}
+
+	serving := *options
+	serving.Refresh = false
+
+	server := &http.Server{Addr: ":8080", Handler: NewRouter(NewServices(&serving, spotifyClient))}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	go func() {
+		if _, ok := <-signals; ok {
+			log.Printf("stopping")
+			server.Shutdown(context.Background())
+		}
+	}()
+
 	log.Printf("listening on :8080")
 
-	if err := http.ListenAndServe(":8080", router); err != nil {
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		return err
 	}
 
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func testServices(t *testing.T, dir string) *Services {
+	options := testOptions(dir)
+	fake := NewFakeMusicService(testLibrary())
+
+	cacher, closeCache, err := OpenSpotifyCacher(options, fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer closeCache()
+
+	playlists, _, err := cacher.Sync(options.User)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := generateSummary(options.State.Summaries(), cacher, options.User, playlists); err != nil {
+		t.Fatal(err)
+	}
+
+	return NewServices(options, fake)
+}
+
+func TestServerHandlers(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(context.Context, *Services, http.ResponseWriter, *http.Request) error
+		url     string
+		vars    map[string]string
+		fails   bool
+		check   func(t *testing.T, body []byte)
+	}{
+		{
+			name:    "playlists",
+			handler: getPlaylists,
+			url:     "/playlists",
+			check: func(t *testing.T, body []byte) {
+				summaries := &PlaylistSummaries{}
+				if err := json.Unmarshal(body, summaries); err != nil {
+					t.Fatal(err)
+				}
+				if len(summaries.Playlists) != 5 {
+					t.Errorf("expected 5 playlists, got %d", len(summaries.Playlists))
+				}
+			},
+		},
+		{
+			name:    "playlist",
+			handler: getPlaylist,
+			url:     "/playlists/feb",
+			vars:    map[string]string{"id": "feb"},
+			check: func(t *testing.T, body []byte) {
+				if len(body) == 0 {
+					t.Errorf("expected the cached playlist")
+				}
+			},
+		},
+		{
+			name:    "missing playlist",
+			handler: getPlaylist,
+			url:     "/playlists/nope",
+			vars:    map[string]string{"id": "nope"},
+			fails:   true,
+		},
+		{
+			name:    "search",
+			handler: searchPlaylists,
+			url:     "/search?q=TRACK+JAN1",
+			check: func(t *testing.T, body []byte) {
+				search := &Search{}
+				if err := json.Unmarshal(body, search); err != nil {
+					t.Fatal(err)
+				}
+				if len(search.Tracks) != 1 {
+					t.Fatalf("expected one track, got %d", len(search.Tracks))
+				}
+				track := search.Tracks[0]
+				if track.ID != "jan1" || len(track.Playlists) != 2 || len(track.Artists) != 1 {
+					t.Errorf("unexpected track: %+v", track)
+				}
+			},
+		},
+		{
+			name:    "search without query",
+			handler: searchPlaylists,
+			url:     "/search",
+			fails:   true,
+		},
+	}
+
+	dir := testTempDir(t)
+	defer os.RemoveAll(dir)
+
+	services := testServices(t, dir)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", test.url, nil)
+			if test.vars != nil {
+				r = mux.SetURLVars(r, test.vars)
+			}
+			w := httptest.NewRecorder()
+
+			err := services.open(func() error {
+				return test.handler(r.Context(), services, w, r)
+			})
+			if test.fails {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if w.Code != http.StatusOK {
+				t.Errorf("expected 200, got %d", w.Code)
+			}
+
+			test.check(t, w.Body.Bytes())
+		})
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	dir := testTempDir(t)
+	defer os.RemoveAll(dir)
+
+	services := testServices(t, dir)
+
+	w := httptest.NewRecorder()
+	NewRouter(services).ServeHTTP(w, httptest.NewRequest("GET", "/playlists/nope", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestServerConcurrentRequests(t *testing.T) {
+	dir := testTempDir(t)
+	defer os.RemoveAll(dir)
+
+	services := testServices(t, dir)
+
+	router := NewRouter(services)
+
+	done := make(chan int, 20)
+	for i := 0; i < cap(done); i++ {
+		url := "/search?q=track"
+		if i%2 == 0 {
+			url = "/playlists/jan"
+		}
+		go func() {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+			done <- w.Code
+		}()
+	}
+
+	for i := 0; i < cap(done); i++ {
+		if code := <-done; code != http.StatusOK {
+			t.Errorf("expected 200, got %d", code)
+		}
+	}
+}
+
+func TestServerSharesCache(t *testing.T) {
+	tests := []struct {
+		name  string
+		cache string
+	}{
+		{"dir", ""},
+		{"bolt", "bolt:"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testTempDir(t)
+			defer os.RemoveAll(dir)
+
+			options := testOptions(dir)
+			if test.cache != "" {
+				options.Cache = test.cache + filepath.Join(dir, "cache.db")
+			}
+
+			services := NewServices(options, NewFakeMusicService(testLibrary()))
+			server := httptest.NewServer(NewRouter(services))
+			defer server.Close()
+
+			res, err := http.Get(server.URL + "/search?q=track")
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("expected 200, got %d", res.StatusCode)
+			}
+
+			opened := make(chan error, 1)
+			go func() {
+				_, closeCache, err := OpenSpotifyCacher(options, NewFakeMusicService(testLibrary()))
+				if err == nil {
+					err = closeCache()
+				}
+				opened <- err
+			}()
+
+			select {
+			case err := <-opened:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("cache still locked by the idle server")
+			}
+		})
+	}
+}
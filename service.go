@@ -0,0 +1,22 @@
+package main
+
+import (
+	"github.com/zmb3/spotify"
+)
+
+type MusicService interface {
+	CurrentUser() (*spotify.PrivateUser, error)
+	GetPlaylistsForUserOpt(userID string, opt *spotify.Options) (*spotify.SimplePlaylistPage, error)
+	GetPlaylistTracksOpt(playlistID spotify.ID, opt *spotify.Options, fields string) (*spotify.PlaylistTrackPage, error)
+	CreatePlaylistForUser(userID, playlistName, description string, public bool) (*spotify.FullPlaylist, error)
+	AddTracksToPlaylist(playlistID spotify.ID, trackIDs ...spotify.ID) (string, error)
+	RemoveTracksFromPlaylist(playlistID spotify.ID, trackIDs ...spotify.ID) (string, error)
+	ReorderPlaylistTracks(playlistID spotify.ID, opt spotify.PlaylistReorderOptions) (string, error)
+	ReplacePlaylistTracks(playlistID spotify.ID, trackIDs ...spotify.ID) error
+	GetAlbum(id spotify.ID) (*spotify.FullAlbum, error)
+	GetAlbumTracksOpt(id spotify.ID, opt *spotify.Options) (*spotify.SimpleTrackPage, error)
+	GetArtistAlbumsOpt(artistID spotify.ID, options *spotify.Options, ts ...spotify.AlbumType) (*spotify.SimpleAlbumPage, error)
+	GetTracks(ids ...spotify.ID) ([]*spotify.FullTrack, error)
+}
+
+var _ MusicService = &spotify.Client{}
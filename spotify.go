@@ -1,14 +1,12 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
-	"math/rand"
-	"regexp"
-	"strings"
-	"time"
-
 	"net/http"
+	"strings"
 
 	"golang.org/x/oauth2"
 
@@ -18,70 +16,149 @@ import (
 )
 
 var (
-	authenticator = spotify.NewAuthenticator(spotifyRedirectUrl, spotify.ScopePlaylistModifyPrivate, spotify.ScopePlaylistModifyPublic, spotify.ScopeUserLibraryModify, spotify.ScopeUserReadPrivate)
-	clientChannel = make(chan *spotify.Client)
+	spotifyScopes = []string{spotify.ScopePlaylistModifyPrivate, spotify.ScopePlaylistModifyPublic, spotify.ScopeUserLibraryModify, spotify.ScopeUserReadPrivate}
 )
 
-func AuthenticateSpotify() (spotifyClient *spotify.Client, err error) {
-	var tokens = ReadTokens()
+// spotifyConfig redirects to the url registered with spotify unless given
+// another one.
+func spotifyConfig(redirect string) *oauth2.Config {
+	if redirect == "" {
+		redirect = spotifyRedirectUrl
+	}
 
-	log.Printf("authenticating with Spotify...")
+	return &oauth2.Config{
+		ClientID:     spotifyClientId,
+		ClientSecret: spotifyClientSecret,
+		RedirectURL:  redirect,
+		Scopes:       spotifyScopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  spotify.AuthURL,
+			TokenURL: spotify.TokenURL,
+		},
+	}
+}
 
-	if tokens.Spotify.AccessToken == "" {
-		http.HandleFunc("/spotify/callback", CompleteAuth)
-		go http.ListenAndServe(":9090", nil)
+// AuthenticateSpotify connects as self using their stored credentials. When
+// no accounts have been added yet, the old single account tokens, or a fresh
+// log in, are stored under whoever they belong to.
+func AuthenticateSpotify(tokensPath, self string, auth *AuthOptions, retry *RetryPolicy) (*spotify.Client, error) {
+	tokens, err := ReadTokens(tokensPath)
+	if err != nil {
+		return nil, err
+	}
 
-		authenticator.SetAuthInfo(spotifyClientId, spotifyClientSecret)
+	log.Printf("authenticating with Spotify as %s...", self)
 
-		url := authenticator.AuthURL(spotifyOauthStateString)
-		log.Println("please log in to Spotify by visiting the following page in your browser:", url)
+	if account, ok := tokens.Accounts[self]; ok {
+		token, err := account.Token()
+		if err != nil {
+			return nil, err
+		}
 
-		spotifyClient = <-clientChannel
+		source := NewPersistentTokenSource(newTokenSource(token), tokensPath, self, token)
+		spotifyClient, _, err := login(source, retry)
+		return spotifyClient, err
+	}
+
+	if len(tokens.Accounts) > 0 {
+		return nil, fmt.Errorf("no spotify account for %s, add one with 'accounts add' (have %s)", self, strings.Join(tokens.Users(), ", "))
+	}
+
+	var token *oauth2.Token
+	if tokens.Spotify != nil {
+		token, err = tokens.Spotify.Token()
 	} else {
-		var oauthToken oauth2.Token
-		oauthToken.AccessToken = tokens.Spotify.AccessToken
-		oauthToken.RefreshToken = tokens.Spotify.RefreshToken
-		oauthToken.Expiry, _ = time.Parse("Mon Jan 2 15:04:05 -0700 MST 2006", tokens.Spotify.Expiry)
-		oauthToken.TokenType = tokens.Spotify.TokenType
-		newClient := authenticator.NewClient(&oauthToken)
-		authenticator.SetAuthInfo(spotifyClientId, spotifyClientSecret)
-		spotifyClient = &newClient
+		token, err = authorize(auth)
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	user, err := spotifyClient.CurrentUser()
+	spotifyClient, user, err := saveAccount(tokensPath, token, retry)
 	if err != nil {
-		return nil, fmt.Errorf("%v", err)
+		return nil, err
 	}
 
-	log.Println("spotify: you are logged in as", user.ID)
+	if user.ID != self {
+		return nil, fmt.Errorf("logged in as %s rather than %s", user.ID, self)
+	}
 
-	return
+	return spotifyClient, nil
+}
+
+// saveAccount logs in with a token whose owner we don't know yet and stores
+// it under their ID, returning a client that keeps it up to date.
+func saveAccount(tokensPath string, token *oauth2.Token, retry *RetryPolicy) (*spotify.Client, *spotify.PrivateUser, error) {
+	source := newTokenSource(token)
+
+	_, user, err := login(source, retry)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	current, err := source.Token()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = UpdateTokens(tokensPath, func(tokens *Tokens) error {
+		tokens.Add(user.ID, current, token)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.Printf("spotify: saved account %s", user.ID)
+
+	spotifyClient := newAuthenticatedClient(NewPersistentTokenSource(source, tokensPath, user.ID, current), retry)
+
+	return spotifyClient, user, nil
 }
 
-func CompleteAuth(w http.ResponseWriter, r *http.Request) {
-	token, err := authenticator.Token(spotifyOauthStateString, r)
+func login(source oauth2.TokenSource, retry *RetryPolicy) (*spotify.Client, *spotify.PrivateUser, error) {
+	// Getting a token first means a revoked one fails here, clearly, rather
+	// than somewhere inside the first request.
+	if _, err := source.Token(); err != nil {
+		if revoked(err) {
+			return nil, nil, &ReauthorizationError{Err: err}
+		}
+		return nil, nil, err
+	}
+
+	spotifyClient := newAuthenticatedClient(source, retry)
+
+	user, err := spotifyClient.CurrentUser()
 	if err != nil {
-		http.Error(w, "unable to get token", http.StatusForbidden)
-		log.Fatal(err)
+		return nil, nil, fmt.Errorf("%v", err)
 	}
 
-	if actualState := r.FormValue("state"); actualState != spotifyOauthStateString {
-		http.NotFound(w, r)
-		log.Fatalf("state mismatch: %s != %s\n", actualState, spotifyOauthStateString)
+	log.Println("spotify: you are logged in as", user.ID)
+
+	return spotifyClient, user, nil
+}
+
+// spotifyContext has the http client oauth2 uses for tokens and requests,
+// with HTTP/2 disabled like zmb3/spotify does, see
+// https://github.com/zmb3/spotify/issues/20
+func spotifyContext() context.Context {
+	transport := &http.Transport{
+		Proxy:        http.ProxyFromEnvironment,
+		TLSNextProto: map[string]func(authority string, c *tls.Conn) http.RoundTripper{},
 	}
+	return context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: transport})
+}
 
-	var tokens = ReadTokens()
-	tokens.Spotify.AccessToken = token.AccessToken
-	tokens.Spotify.RefreshToken = token.RefreshToken
-	tokens.Spotify.Expiry = token.Expiry.Format("Mon Jan 2 15:04:05 -0700 MST 2006")
-	tokens.Spotify.TokenType = token.TokenType
-	WriteTokens(tokens)
+func newTokenSource(token *oauth2.Token) oauth2.TokenSource {
+	return spotifyConfig("").TokenSource(spotifyContext(), token)
+}
 
-	client := authenticator.NewClient(token)
-	clientChannel <- &client
+func newAuthenticatedClient(source oauth2.TokenSource, retry *RetryPolicy) *spotify.Client {
+	client := spotify.NewClient(retry.Client(oauth2.NewClient(spotifyContext(), source)))
+	return &client
 }
 
-func GetPlaylistByTitle(spotifyClient *spotify.Client, user, name string) (*spotify.SimplePlaylist, error) {
+func GetPlaylistByTitle(spotifyClient MusicService, user, name string) (*spotify.SimplePlaylist, error) {
 	limit := 20
 	offset := 0
 	options := spotify.Options{Limit: &limit, Offset: &offset}
@@ -108,7 +185,7 @@ func GetPlaylistByTitle(spotifyClient *spotify.Client, user, name string) (*spot
 	return nil, nil
 }
 
-func GetPlaylist(spotifyClient *spotify.Client, user string, name string) (pl *spotify.SimplePlaylist, err error) {
+func GetPlaylist(spotifyClient MusicService, user string, name string) (pl *spotify.SimplePlaylist, err error) {
 	log.Printf("looking for '%s'...", name)
 
 	pl, err = GetPlaylistByTitle(spotifyClient, user, name)
@@ -133,14 +210,21 @@ func GetPlaylist(spotifyClient *spotify.Client, user string, name string) (pl *s
 }
 
 type PlaylistUpdate struct {
-	idsBefore mapset.Set
-	idsAfter  []spotify.ID
+	idsBefore     mapset.Set
+	orderedBefore []spotify.ID
+	idsAfter      []spotify.ID
+}
+
+type PlaylistMove struct {
+	From int
+	To   int
 }
 
 func NewPlaylistUpdate(idsBefore []spotify.ID) *PlaylistUpdate {
 	return &PlaylistUpdate{
-		idsBefore: mapset.NewSetFromSlice(MapIds(idsBefore)),
-		idsAfter:  make([]spotify.ID, 0),
+		idsBefore:     mapset.NewSetFromSlice(MapIds(idsBefore)),
+		orderedBefore: append([]spotify.ID{}, idsBefore...),
+		idsAfter:      make([]spotify.ID, 0),
 	}
 }
 
@@ -148,22 +232,92 @@ func (pu *PlaylistUpdate) AddTrack(id spotify.ID) {
 	pu.idsAfter = append(pu.idsAfter, id)
 }
 
+// Removing a track removes every copy of it, so tracks that are in the
+// playlist more than once are removed and, if staying, added back once.
+func (pu *PlaylistUpdate) duplicated() *TracksSet {
+	seen := NewEmptyTracksSet()
+	duplicated := NewEmptyTracksSet()
+	for _, id := range pu.orderedBefore {
+		if len(id) == 0 {
+			continue
+		}
+		if !seen.Contains(id) {
+			seen.Add(id)
+		} else if !duplicated.Contains(id) {
+			duplicated.Add(id)
+		}
+	}
+	return duplicated
+}
+
 func (pu *PlaylistUpdate) GetIdsToRemove() *TracksSet {
 	afterSet := mapset.NewSetFromSlice(MapIds(pu.idsAfter))
 	idsToRemove := pu.idsBefore.Difference(afterSet)
-	return NewTracksSet(ToSpotifyIds(idsToRemove.ToSlice()))
+	idsToRemove.Remove(spotify.ID(""))
+	ids := ToSpotifyIds(idsToRemove.ToSlice())
+	for _, id := range pu.duplicated().ToArray() {
+		if afterSet.Contains(id) {
+			ids = append(ids, id)
+		}
+	}
+	return NewTracksSet(ids)
 }
 
 func (pu *PlaylistUpdate) GetIdsToAdd() *TracksSet {
+	duplicated := pu.duplicated()
 	ids := make([]spotify.ID, 0)
 	for _, id := range pu.idsAfter {
-		if !pu.idsBefore.Contains(id) {
+		if len(id) == 0 {
+			continue
+		}
+		if !pu.idsBefore.Contains(id) || duplicated.Contains(id) {
 			ids = append(ids, id)
 		}
 	}
 	return NewTracksSet(ids)
 }
 
+func (pu *PlaylistUpdate) GetIdsAfter() *TracksSet {
+	return NewTracksSet(pu.idsAfter)
+}
+
+// Moves are relative to the playlist after removing and appending tracks,
+// each one applied in order. Duplicates are gone by then, having been
+// removed and added back once.
+func (pu *PlaylistUpdate) GetMoves() []PlaylistMove {
+	removing := pu.GetIdsToRemove()
+
+	current := make([]spotify.ID, 0)
+	for _, id := range pu.orderedBefore {
+		if !removing.Contains(id) {
+			current = append(current, id)
+		}
+	}
+	current = append(current, pu.GetIdsToAdd().ToArray()...)
+
+	moves := make([]PlaylistMove, 0)
+	for i, id := range pu.idsAfter {
+		j := -1
+		for k := i; k < len(current); k++ {
+			if current[k] == id {
+				j = k
+				break
+			}
+		}
+
+		if j <= i {
+			continue
+		}
+
+		moves = append(moves, PlaylistMove{From: j, To: i})
+
+		copy(current[i+1:j+1], current[i:j])
+		current[i] = id
+	}
+
+	return moves
+}
+
 func (pu *PlaylistUpdate) MergeBeforeAndToAdd() {
 	for _, id := range pu.idsAfter {
 		pu.idsBefore.Add(id)
@@ -174,13 +328,13 @@ func (pu *PlaylistUpdate) Contains(id spotify.ID) bool {
 	return pu.idsBefore.Contains(id)
 }
 
-func GetArtistAlbums(spotifyClient *spotify.Client, id spotify.ID) ([]spotify.SimpleAlbum, error) {
+func GetArtistAlbums(spotifyClient MusicService, id spotify.ID) ([]spotify.SimpleAlbum, error) {
 	all := make([]spotify.SimpleAlbum, 0)
 	limit := 20
 	offset := 0
 	options := spotify.Options{Limit: &limit, Offset: &offset}
 	for {
-		albums, err := spotifyClient.GetArtistAlbumsOpt(id, &options, nil)
+		albums, err := spotifyClient.GetArtistAlbumsOpt(id, &options)
 		if err != nil {
 			return nil, fmt.Errorf("unable to get albums: %v", err)
 		}
@@ -198,12 +352,12 @@ func GetArtistAlbums(spotifyClient *spotify.Client, id spotify.ID) ([]spotify.Si
 	return all, nil
 }
 
-func GetAlbumTracks(spotifyClient *spotify.Client, id spotify.ID) ([]spotify.SimpleTrack, error) {
+func GetAlbumTracks(spotifyClient MusicService, id spotify.ID) ([]spotify.SimpleTrack, error) {
 	all := make([]spotify.SimpleTrack, 0)
 	limit := 20
 	offset := 0
 	for {
-		tracks, err := spotifyClient.GetAlbumTracksOpt(id, limit, offset)
+		tracks, err := spotifyClient.GetAlbumTracksOpt(id, &spotify.Options{Limit: &limit, Offset: &offset})
 		if err != nil {
 			return nil, fmt.Errorf("unable to get tracks: %v", err)
 		}
@@ -220,7 +374,7 @@ func GetAlbumTracks(spotifyClient *spotify.Client, id spotify.ID) ([]spotify.Sim
 	return all, nil
 }
 
-func GetPlaylistTracks(spotifyClient *spotify.Client, id spotify.ID) ([]spotify.PlaylistTrack, error) {
+func GetPlaylistTracks(spotifyClient MusicService, id spotify.ID) ([]spotify.PlaylistTrack, error) {
 	all := make([]spotify.PlaylistTrack, 0)
 	limit := 100
 	offset := 0
@@ -244,7 +398,7 @@ func GetPlaylistTracks(spotifyClient *spotify.Client, id spotify.ID) ([]spotify.
 	return all, nil
 }
 
-func RemoveAllPlaylistTracks(spotifyClient *spotify.Client, id spotify.ID) error {
+func RemoveAllPlaylistTracks(spotifyClient MusicService, id spotify.ID) error {
 	tracks, err := GetPlaylistTracks(spotifyClient, id)
 	if err != nil {
 		return err
@@ -338,39 +492,7 @@ func (ts *TracksSet) ToArray() []spotify.ID {
 	return ts.Ordered
 }
 
-func (ts *TracksSet) Sample(number int) (ns *TracksSet) {
-	if len(ts.Ids) < number {
-		panic("not enough tracks to sample from")
-	}
-
-	array := ts.ToArray()
-
-	ids := make(map[spotify.ID]bool)
-	ordered := make([]spotify.ID, 0)
-
-	if len(array) > 0 {
-		for len(ids) < number {
-			i := rand.Uint32() % uint32(len(array))
-			id := array[i]
-
-			if len(id) == 0 {
-				log.Printf("skip empty id (%d / %d)", i, len(array))
-			} else {
-				if _, ok := ids[id]; !ok {
-					ids[id] = true
-					ordered = append(ordered, id)
-				}
-			}
-		}
-	}
-
-	return &TracksSet{
-		Ids:     ids,
-		Ordered: ordered,
-	}
-}
-
-func RemoveTracksFromPlaylist(spotifyClient *spotify.Client, id spotify.ID, ids []spotify.ID) (err error) {
+func RemoveTracksFromPlaylist(spotifyClient MusicService, id spotify.ID, ids []spotify.ID) (err error) {
 	for i := 0; i < len(ids); i += 50 {
 		batch := ids[i:min(i+50, len(ids))]
 		_, err := spotifyClient.RemoveTracksFromPlaylist(id, batch...)
@@ -383,7 +505,7 @@ func RemoveTracksFromPlaylist(spotifyClient *spotify.Client, id spotify.ID, ids
 	return nil
 }
 
-func AddTracksToPlaylist(spotifyClient *spotify.Client, id spotify.ID, ids []spotify.ID) (err error) {
+func AddTracksToPlaylist(spotifyClient MusicService, id spotify.ID, ids []spotify.ID) (err error) {
 	if true {
 		for _, id := range ids {
 			log.Printf("adding: %s", id)
@@ -401,11 +523,11 @@ func AddTracksToPlaylist(spotifyClient *spotify.Client, id spotify.ID, ids []spo
 	return nil
 }
 
-func RemoveTracksSetFromPlaylist(spotifyClient *spotify.Client, id spotify.ID, ts *TracksSet) (err error) {
+func RemoveTracksSetFromPlaylist(spotifyClient MusicService, id spotify.ID, ts *TracksSet) (err error) {
 	return RemoveTracksFromPlaylist(spotifyClient, id, ts.ToArray())
 }
 
-func AddTracksSetToPlaylist(spotifyClient *spotify.Client, id spotify.ID, ts *TracksSet) (err error) {
+func AddTracksSetToPlaylist(spotifyClient MusicService, id spotify.ID, ts *TracksSet) (err error) {
 	return AddTracksToPlaylist(spotifyClient, id, ts.ToArray())
 }
 
@@ -430,14 +552,9 @@ func (ps *PlaylistSet) GetAllTracks() (nps *PlaylistSet) {
 }
 
 func (ps *PlaylistSet) Monthly() (nps *PlaylistSet) {
-	filter := regexp.MustCompile("[^A-Za-z0-9\\s]")
-	monthly := regexp.MustCompile("(?i)^((\\d\\d\\d\\d )?(january|february|march|april|may|june|july|august|september|october|november|december)( \\d\\d\\d\\d)?)$")
-
 	playlists := make([]Playlist, 0)
 	for _, pl := range ps.Playlists {
-		filtered := filter.ReplaceAllString(pl.Name, "")
-
-		if monthly.MatchString(filtered) {
+		if _, ok := ParseMonthlyName(pl.Name); ok {
 			playlists = append(playlists, pl)
 		}
 	}
@@ -499,7 +616,7 @@ func MapIds(ids []spotify.ID) (ifaces []interface{}) {
 	return
 }
 
-func SetPlaylistTracks(spotifyClient *spotify.Client, id spotify.ID, tracks []spotify.ID) error {
+func SetPlaylistTracks(spotifyClient MusicService, id spotify.ID, tracks []spotify.ID) error {
 	err := RemoveAllPlaylistTracks(spotifyClient, id)
 	if err != nil {
 		return fmt.Errorf("error getting removing tracks: %v", err)
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zmb3/spotify"
+)
+
+func splitIds(value string) []spotify.ID {
+	ids := make([]spotify.ID, 0)
+	for _, id := range strings.Fields(value) {
+		ids = append(ids, spotify.ID(id))
+	}
+	return ids
+}
+
+func TestPlaylistUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		before  string
+		after   string
+		removed int
+		added   int
+	}{
+		{"unchanged", "a b c", "a b c", 0, 0},
+		{"replaced", "a b c", "d e f", 3, 3},
+		{"reordered", "a b c", "c a b", 0, 0},
+		{"kept and added", "a b c d", "b d e f", 2, 2},
+		{"kept moved to the front", "a b c d", "d b e", 2, 1},
+		{"duplicates removed", "a b a c b", "a b c", 2, 2},
+		{"duplicate dropped", "a b a c", "b c d", 1, 1},
+		{"duplicates kept and reordered", "c a c b a", "a b c e", 2, 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testTempDir(t)
+			defer os.RemoveAll(dir)
+
+			tracks := make([]spotify.PlaylistTrack, 0)
+			for _, id := range splitIds(test.before) {
+				tracks = append(tracks, testTrack(string(id), "artist", "album", testEpoch))
+			}
+			f := NewFakeMusicService(testFixture(testPlaylist("pl", "Playlist", tracks)))
+
+			before := splitIds(test.before)
+			after := splitIds(test.after)
+
+			update := NewPlaylistUpdate(before)
+			for _, id := range after {
+				update.AddTrack(id)
+			}
+
+			if removed := len(update.GetIdsToRemove().Ids); removed != test.removed {
+				t.Errorf("expected to remove %d, got %v", test.removed, update.GetIdsToRemove().ToArray())
+			}
+			if added := len(update.GetIdsToAdd().Ids); added != test.added {
+				t.Errorf("expected to add %d, got %v", test.added, update.GetIdsToAdd().ToArray())
+			}
+
+			tx := NewPlaylistTransaction(filepath.Join(dir, "tx.json"), "pl", before, update)
+			if err := tx.Commit(f); err != nil {
+				t.Fatal(err)
+			}
+
+			if actual := strings.Join(playlistIds(f, "pl"), " "); actual != test.after {
+				t.Errorf("expected %q, got %q", test.after, actual)
+			}
+		})
+	}
+}
+
+func TestKeptCandidates(t *testing.T) {
+	existing := testTracks("t", 4, testEpoch)
+	existing = append(existing, existing[1])
+
+	kept := NewTracksSet(splitIds("t3 t1"))
+
+	ids := make([]spotify.ID, 0)
+	for _, c := range keptCandidates(existing, kept) {
+		ids = append(ids, c.ID)
+	}
+
+	if expected := splitIds("t1 t3"); !reflect.DeepEqual(ids, expected) {
+		t.Errorf("expected %v, got %v", expected, ids)
+	}
+}
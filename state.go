@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/zmb3/spotify"
+)
+
+const StateEnvironmentVariable = "PLAYLIST_GENERATOR_STATE"
+
+// StateDirectory holds everything the generator keeps between runs, the
+// cache, tokens, history and summaries, so several profiles can live side by
+// side by pointing each at its own directory.
+type StateDirectory struct {
+	Path string
+}
+
+// DefaultStateDirectory is $PLAYLIST_GENERATOR_STATE, falling back to
+// playlist-generator under $XDG_STATE_HOME or ~/.local/state.
+func DefaultStateDirectory() string {
+	if path := os.Getenv(StateEnvironmentVariable); path != "" {
+		return path
+	}
+
+	if xdg := os.Getenv("XDG_STATE_HOME"); filepath.IsAbs(xdg) {
+		return filepath.Join(xdg, "playlist-generator")
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "."
+	}
+
+	return filepath.Join(home, ".local", "state", "playlist-generator")
+}
+
+func (s *StateDirectory) Create() error {
+	err := os.MkdirAll(s.Path, 0700)
+	if err != nil {
+		return fmt.Errorf("error creating state directory: %v", err)
+	}
+	return nil
+}
+
+func (s *StateDirectory) Join(name string) string {
+	return filepath.Join(s.Path, name)
+}
+
+func (s *StateDirectory) Cache() string {
+	return "dir:" + s.Join("cache")
+}
+
+func (s *StateDirectory) Summaries() string {
+	return s.Join("playlists.json")
+}
+
+func (s *StateDirectory) Log() string {
+	return s.Join("generator.log")
+}
+
+func (s *StateDirectory) Tokens() string {
+	return s.Join("tokens.json")
+}
+
+func (s *StateDirectory) History() string {
+	return s.Join("history.json")
+}
+
+func (s *StateDirectory) Transaction(id spotify.ID) string {
+	return s.Join(fmt.Sprintf("transaction-%s.json", id))
+}
+
+// legacyState is what older versions kept in the working directory, and its
+// name in the state directory.
+var legacyState = map[string]string{
+	"tokens.json":    "tokens.json",
+	"history.json":   "history.json",
+	"playlists.json": "playlists.json",
+	"generator.log":  "generator.log",
+	".cache":         "cache",
+}
+
+// legacyCache is true when the .cache directory is ours, rather than, say,
+// the one in a home directory.
+func legacyCache(path string) bool {
+	matches, err := filepath.Glob(filepath.Join(path, "playlist*-*.json"))
+	return err == nil && len(matches) > 0
+}
+
+// legacy finds what an older version left in dir, mapping each path there
+// to where it belongs in the state directory.
+func (s *StateDirectory) legacy(dir string) (map[string]string, error) {
+	from, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	to, err := filepath.Abs(s.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]string)
+
+	if from == to {
+		return found, nil
+	}
+
+	names := make(map[string]string)
+	for name, target := range legacyState {
+		names[name] = target
+	}
+
+	transactions, err := filepath.Glob(filepath.Join(from, "transaction-*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range transactions {
+		names[filepath.Base(path)] = filepath.Base(path)
+	}
+
+	for name, target := range names {
+		legacy := filepath.Join(from, name)
+		if _, err := os.Stat(legacy); os.IsNotExist(err) {
+			continue
+		}
+
+		if name == ".cache" && !legacyCache(legacy) {
+			continue
+		}
+
+		found[legacy] = s.Join(target)
+	}
+
+	return found, nil
+}
+
+// CheckLegacy points out state an older version left in dir, which is only
+// moved when asked to with the state migrate command.
+func (s *StateDirectory) CheckLegacy(dir string) {
+	found, err := s.legacy(dir)
+	if err != nil || len(found) == 0 {
+		return
+	}
+
+	for legacy, moving := range found {
+		if _, err := os.Stat(moving); os.IsNotExist(err) {
+			log.Printf("state: found %s from an older version, run 'state migrate %s' to move it to %s", legacy, dir, moving)
+		}
+	}
+}
+
+// MigrateLegacy moves state an older version left in dir into the state
+// directory. Anything already there is kept, and anything that can't be
+// moved is left where it is, either way saying so.
+func (s *StateDirectory) MigrateLegacy(dir string) (moved int, err error) {
+	found, err := s.legacy(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	for legacy, moving := range found {
+		if _, err := os.Stat(moving); err == nil {
+			log.Printf("state: leaving %s, %s already exists", legacy, moving)
+			continue
+		}
+
+		if err := os.Rename(legacy, moving); err != nil {
+			log.Printf("state: unable to move %s to %s, move it there to keep using it: %v", legacy, moving, err)
+			continue
+		}
+
+		log.Printf("state: moved %s to %s", legacy, moving)
+
+		moved += 1
+	}
+
+	return moved, nil
+}
+
+func stateCommand(options *Options, args []string) error {
+	usage := fmt.Errorf("usage: state migrate [DIR]")
+	if len(args) == 0 || len(args) > 2 {
+		return usage
+	}
+
+	switch args[0] {
+	case "migrate":
+		dir := "."
+		if len(args) == 2 {
+			dir = args[1]
+		}
+
+		moved, err := options.State.MigrateLegacy(dir)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("state: moved %d from %s to %s", moved, dir, options.State.Path)
+	default:
+		return fmt.Errorf("unknown state command: %v", args[0])
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStateMigrateLegacy(t *testing.T) {
+	legacy := testTempDir(t)
+	defer os.RemoveAll(legacy)
+
+	state := &StateDirectory{Path: filepath.Join(legacy, "state")}
+	if err := state.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"tokens.json", "history.json", "transaction-pl.json", ".cache/playlist-pl.json", "generator.log"} {
+		path := filepath.Join(legacy, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Already in the state directory, so the legacy one stays put.
+	if err := ioutil.WriteFile(state.Log(), []byte("newer"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	state.CheckLegacy(legacy)
+
+	if _, err := os.Stat(filepath.Join(legacy, "tokens.json")); err != nil {
+		t.Fatalf("expected tokens.json to be left until migrating: %v", err)
+	}
+
+	moved, err := state.MigrateLegacy(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 4 {
+		t.Errorf("expected 4 moved, got %d", moved)
+	}
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{state.Tokens(), "tokens.json"},
+		{state.History(), "history.json"},
+		{state.Transaction("pl"), "transaction-pl.json"},
+		{state.Join("cache/playlist-pl.json"), ".cache/playlist-pl.json"},
+		{state.Log(), "newer"},
+		{filepath.Join(legacy, "generator.log"), "generator.log"},
+	}
+
+	for _, test := range tests {
+		data, err := ioutil.ReadFile(test.path)
+		if err != nil {
+			t.Errorf("%v", err)
+			continue
+		}
+		if string(data) != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.path, test.expected, data)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(legacy, "tokens.json")); !os.IsNotExist(err) {
+		t.Errorf("expected tokens.json to be moved: %v", err)
+	}
+}
+
+func TestStateMigrateIgnoresOtherCaches(t *testing.T) {
+	home := testTempDir(t)
+	defer os.RemoveAll(home)
+
+	other := filepath.Join(home, ".cache", "someone-else")
+	if err := os.MkdirAll(other, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	state := &StateDirectory{Path: filepath.Join(home, "state")}
+	if err := state.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := state.MigrateLegacy(home); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("expected an unrelated .cache to be left alone: %v", err)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Storage holds the cached JSON documents, keyed by names like
+// "playlist-ID" or "track-ID". Get returns nil for missing keys.
+type Storage interface {
+	Get(key string) ([]byte, error)
+	Put(key string, data []byte) error
+	Delete(key string) error
+	Has(key string) bool
+	Keys() ([]string, error)
+	Close() error
+}
+
+// Storage is given as dir:PATH or bolt:PATH, a bare path being a directory.
+func parseStorage(spec string) (kind, path string, err error) {
+	kind, path = "dir", spec
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, path = spec[:i], spec[i+1:]
+	}
+
+	if path == "" {
+		return "", "", fmt.Errorf("cache storage missing path: %v", spec)
+	}
+
+	return
+}
+
+func OpenStorage(spec string) (Storage, error) {
+	kind, path, err := parseStorage(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case "dir":
+		return NewDirectoryStorage(path)
+	case "bolt":
+		return NewBoltStorage(path)
+	}
+
+	return nil, fmt.Errorf("unknown cache storage: %v", kind)
+}
+
+// LockStorage keeps other processes, like the generator and the server, from
+// using the same cache at once.
+func LockStorage(spec string) (*FileLock, error) {
+	kind, path, err := parseStorage(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if kind == "dir" {
+		err := os.MkdirAll(path, 0755)
+		if err != nil {
+			return nil, fmt.Errorf("error creating cache: %v", err)
+		}
+
+		return LockFile(filepath.Join(path, ".lock"))
+	}
+
+	return LockFile(path + ".lock")
+}
+
+type DirectoryStorage struct {
+	Path string
+}
+
+func NewDirectoryStorage(path string) (*DirectoryStorage, error) {
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cache: %v", err)
+	}
+
+	return &DirectoryStorage{
+		Path: path,
+	}, nil
+}
+
+func (ds *DirectoryStorage) path(key string) string {
+	return filepath.Join(ds.Path, key+".json")
+}
+
+func (ds *DirectoryStorage) Get(key string) ([]byte, error) {
+	data, err := ioutil.ReadFile(ds.path(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading: %v", err)
+	}
+	return data, nil
+}
+
+func (ds *DirectoryStorage) Put(key string, data []byte) error {
+	return WriteFileAtomic(ds.path(key), data, 0644)
+}
+
+func (ds *DirectoryStorage) Delete(key string) error {
+	err := os.Remove(ds.path(key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (ds *DirectoryStorage) Has(key string) bool {
+	_, err := os.Stat(ds.path(key))
+	return err == nil
+}
+
+func (ds *DirectoryStorage) Keys() ([]string, error) {
+	files, err := ioutil.ReadDir(ds.Path)
+	if err != nil {
+		return nil, fmt.Errorf("error listing cache: %v", err)
+	}
+
+	keys := make([]string, 0)
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".json") {
+			keys = append(keys, strings.TrimSuffix(f.Name(), ".json"))
+		}
+	}
+
+	return keys, nil
+}
+
+func (ds *DirectoryStorage) Close() error {
+	return nil
+}
+
+var boltBucket = []byte("cache")
+
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+func NewBoltStorage(path string) (*BoltStorage, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening cache %v: %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error opening cache %v: %v", path, err)
+	}
+
+	return &BoltStorage{
+		db: db,
+	}, nil
+}
+
+func (bs *BoltStorage) Get(key string) (data []byte, err error) {
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		if value := tx.Bucket(boltBucket).Get([]byte(key)); value != nil {
+			data = append([]byte{}, value...)
+		}
+		return nil
+	})
+	return
+}
+
+func (bs *BoltStorage) Put(key string, data []byte) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(key), data)
+	})
+}
+
+func (bs *BoltStorage) Delete(key string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(key))
+	})
+}
+
+func (bs *BoltStorage) Has(key string) bool {
+	found := false
+	bs.db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket(boltBucket).Get([]byte(key)) != nil
+		return nil
+	})
+	return found
+}
+
+func (bs *BoltStorage) Keys() ([]string, error) {
+	keys := make([]string, 0)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	return keys, err
+}
+
+func (bs *BoltStorage) Close() error {
+	return bs.db.Close()
+}
+
+func MigrateStorage(from, to Storage) (int, error) {
+	keys, err := from.Keys()
+	if err != nil {
+		return 0, err
+	}
+
+	sort.Strings(keys)
+
+	for i, key := range keys {
+		data, err := from.Get(key)
+		if err != nil {
+			return i, fmt.Errorf("error migrating %v: %v", key, err)
+		}
+
+		err = to.Put(key, data)
+		if err != nil {
+			return i, fmt.Errorf("error migrating %v: %v", key, err)
+		}
+
+		if (i+1)%1000 == 0 {
+			log.Printf("migrated %d/%d", i+1, len(keys))
+		}
+	}
+
+	return len(keys), nil
+}
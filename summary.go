@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	_ "log"
+	"sort"
 	"time"
 
 	"github.com/zmb3/spotify"
@@ -26,6 +27,8 @@ type PlaylistSummary struct {
 	LastModified   time.Time      `json:"lastModified"`
 	Subscribed     bool           `json:"subscribed"`
 	SnapshotID     string         `json:"snapshot"`
+	Year           int            `json:"year,omitempty"`
+	Month          time.Month     `json:"month,omitempty"`
 }
 
 type Playlist struct {
@@ -61,8 +64,13 @@ func Summarize(pl Playlist, tracks []spotify.PlaylistTrack) (ps *PlaylistSummary
 		},
 	}
 
+	if pm, ok := ResolvePlaylistMonth(pl, tracks); ok {
+		ps.Year = pm.Year
+		ps.Month = pm.Month
+	}
+
 	for _, track := range tracks {
-		addedAt, err := time.Parse("2006-01-02T15:04:05Z", track.AddedAt)
+		addedAt, err := ParseAddedAt(track.AddedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -75,6 +83,23 @@ func Summarize(pl Playlist, tracks []spotify.PlaylistTrack) (ps *PlaylistSummary
 	return
 }
 
+func (ps *PlaylistSummaries) SortChronologically() {
+	sort.SliceStable(ps.Playlists, func(i, j int) bool {
+		a, b := ps.Playlists[i], ps.Playlists[j]
+		if a.Month == 0 || b.Month == 0 {
+			return a.Month != 0 && b.Month == 0
+		}
+		if a.Year != b.Year {
+			return a.Year < b.Year
+		}
+		return a.Month < b.Month
+	})
+}
+
+func ParseAddedAt(value string) (time.Time, error) {
+	return time.Parse("2006-01-02T15:04:05Z", value)
+}
+
 func LoadSummaries(path string) (summaries *PlaylistSummaries, err error) {
 	file, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/zmb3/spotify"
+)
+
+type PlaylistChange struct {
+	ID      spotify.ID `json:"id"`
+	Name    string     `json:"name"`
+	OldName string     `json:"oldName,omitempty"`
+}
+
+type SyncSummary struct {
+	User      string            `json:"user"`
+	Started   time.Time         `json:"started"`
+	Elapsed   time.Duration     `json:"elapsed"`
+	Added     []*PlaylistChange `json:"added"`
+	Changed   []*PlaylistChange `json:"changed"`
+	Renamed   []*PlaylistChange `json:"renamed"`
+	Deleted   []*PlaylistChange `json:"deleted"`
+	Unchanged int               `json:"unchanged"`
+	Fetched   int               `json:"fetched"`
+}
+
+func (s *SyncSummary) Log() {
+	for _, c := range s.Added {
+		log.Printf("sync: added %v %v", c.ID, c.Name)
+	}
+	for _, c := range s.Changed {
+		log.Printf("sync: changed %v %v", c.ID, c.Name)
+	}
+	for _, c := range s.Renamed {
+		log.Printf("sync: renamed %v '%v' to '%v'", c.ID, c.OldName, c.Name)
+	}
+	for _, c := range s.Deleted {
+		log.Printf("sync: deleted %v %v", c.ID, c.Name)
+	}
+
+	log.Printf("sync: %v added, %v changed, %v renamed, %v deleted, %v unchanged, fetched %v playlists in %v",
+		len(s.Added), len(s.Changed), len(s.Renamed), len(s.Deleted), s.Unchanged, s.Fetched, s.Elapsed)
+}
+
+func (sc *SpotifyCacher) cachedPlaylists(user string) (*PlaylistSet, error) {
+	key := fmt.Sprintf("playlists-%s", user)
+	cached, err := sc.lookup(key, &PlaylistSet{})
+	if err != nil {
+		return nil, err
+	}
+	if cached == nil {
+		return &PlaylistSet{}, nil
+	}
+	return cached.(*PlaylistSet), nil
+}
+
+func (sc *SpotifyCacher) hasPlaylistTracks(id spotify.ID) bool {
+	if sc.refresh {
+		return false
+	}
+
+	return sc.has(fmt.Sprintf("playlist-%s", id))
+}
+
+// Sync refreshes the user's playlists, only downloading tracks for those
+// whose snapshot changed since the last sync or that aren't cached, and
+// dropping the cached tracks of deleted playlists.
+func (sc *SpotifyCacher) Sync(user string) (*PlaylistSet, *SyncSummary, error) {
+	summary := &SyncSummary{
+		User:    user,
+		Started: time.Now(),
+		Added:   make([]*PlaylistChange, 0),
+		Changed: make([]*PlaylistChange, 0),
+		Renamed: make([]*PlaylistChange, 0),
+		Deleted: make([]*PlaylistChange, 0),
+	}
+
+	old, err := sc.cachedPlaylists(user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	playlists, err := sc.fetchPlaylists(user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	previous := make(map[spotify.ID]Playlist)
+	for _, pl := range old.Playlists {
+		previous[pl.ID] = pl
+	}
+
+	current := make(map[spotify.ID]bool)
+	for _, pl := range playlists.Playlists {
+		current[pl.ID] = true
+
+		change := &PlaylistChange{
+			ID:   pl.ID,
+			Name: pl.Name,
+		}
+
+		before, ok := previous[pl.ID]
+		if !ok {
+			summary.Added = append(summary.Added, change)
+		} else {
+			if before.Name != pl.Name {
+				change.OldName = before.Name
+				summary.Renamed = append(summary.Renamed, change)
+			}
+
+			if before.SnapshotID != pl.SnapshotID {
+				sc.Invalidate(pl.ID)
+				summary.Changed = append(summary.Changed, change)
+			} else {
+				summary.Unchanged += 1
+			}
+		}
+
+		if !sc.hasPlaylistTracks(pl.ID) {
+			summary.Fetched += 1
+		}
+	}
+
+	for _, pl := range old.Playlists {
+		if !current[pl.ID] {
+			sc.Invalidate(pl.ID)
+			summary.Deleted = append(summary.Deleted, &PlaylistChange{
+				ID:   pl.ID,
+				Name: pl.Name,
+			})
+		}
+	}
+
+	_, err = sc.GetPlaylistsTracks(user, playlists.Playlists)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	summary.Elapsed = time.Since(summary.Started)
+
+	return playlists, summary, nil
+}
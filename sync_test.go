@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/zmb3/spotify"
+)
+
+func changedIds(changes []*PlaylistChange) []string {
+	ids := make([]string, 0)
+	for _, c := range changes {
+		ids = append(ids, string(c.ID))
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestSync(t *testing.T) {
+	dir := testTempDir(t)
+	defer os.RemoveAll(dir)
+
+	options := testOptions(dir)
+	fake := NewFakeMusicService(testLibrary())
+
+	cacher, closeCache, err := OpenSpotifyCacher(options, fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer closeCache()
+
+	resync := func() *SyncSummary {
+		fake.Calls = make([]string, 0)
+		_, summary, err := cacher.Sync(options.User)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return summary
+	}
+
+	first := resync()
+	if len(first.Added) != 5 || first.Fetched != 5 || countCalls(fake, "GetPlaylistTracksOpt") != 5 {
+		t.Fatalf("expected every playlist fetched, got %+v", first)
+	}
+
+	second := resync()
+	if len(second.Added) != 0 || second.Unchanged != 5 || second.Fetched != 0 || countCalls(fake, "GetPlaylistTracksOpt") != 0 {
+		t.Fatalf("expected nothing fetched, got %+v", second)
+	}
+
+	// Change jan, rename feb, delete mar and create another.
+	if _, err := fake.AddTracksToPlaylist("jan", "feb1"); err != nil {
+		t.Fatal(err)
+	}
+	fixture := fake.Fixture()
+	fixture.Playlists[1].Playlist.Name = "Feb 2019"
+	fixture.Playlists = append(fixture.Playlists[:2], fixture.Playlists[3:]...)
+	created, err := fake.CreatePlaylistForUser("tester", "Created", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	third := resync()
+
+	expected := map[string][]string{
+		"added":   {string(created.ID)},
+		"changed": {"jan"},
+		"renamed": {"feb"},
+		"deleted": {"mar"},
+	}
+	actual := map[string][]string{
+		"added":   changedIds(third.Added),
+		"changed": changedIds(third.Changed),
+		"renamed": changedIds(third.Renamed),
+		"deleted": changedIds(third.Deleted),
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+
+	if third.Renamed[0].OldName != "February 2019" || third.Renamed[0].Name != "Feb 2019" {
+		t.Errorf("unexpected rename: %+v", third.Renamed[0])
+	}
+
+	// Renamed playlists keep their tracks.
+	if third.Unchanged != 3 || third.Fetched != 2 || countCalls(fake, "GetPlaylistTracksOpt") != 2 {
+		t.Errorf("expected jan and the new playlist fetched, got %+v and %v", third, fake.Calls)
+	}
+
+	if cacher.hasPlaylistTracks(spotify.ID("mar")) {
+		t.Errorf("expected the deleted playlist's tracks dropped")
+	}
+
+	tracks, err := cacher.GetPlaylistTracks(options.User, "jan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 11 {
+		t.Errorf("expected the changed playlist refetched, got %d tracks", len(tracks))
+	}
+}
@@ -1,12 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"net/http"
 	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
 )
 
+// Older token files stored expiry in this layout, newer ones use RFC3339.
+const legacyTokenExpiryLayout = "Mon Jan 2 15:04:05 -0700 MST 2006"
+
 type SpotifyTokens struct {
 	AccessToken  string
 	RefreshToken string
@@ -14,40 +25,196 @@ type SpotifyTokens struct {
 	TokenType    string
 }
 
+func NewSpotifyTokens(token *oauth2.Token) *SpotifyTokens {
+	expiry := ""
+	if !token.Expiry.IsZero() {
+		expiry = token.Expiry.Format(time.RFC3339)
+	}
+
+	return &SpotifyTokens{
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		Expiry:       expiry,
+		TokenType:    token.TokenType,
+	}
+}
+
+func (st *SpotifyTokens) Token() (*oauth2.Token, error) {
+	token := &oauth2.Token{
+		AccessToken:  st.AccessToken,
+		RefreshToken: st.RefreshToken,
+		TokenType:    st.TokenType,
+	}
+
+	if st.Expiry != "" {
+		expiry, err := time.Parse(time.RFC3339, st.Expiry)
+		if err != nil {
+			expiry, err = time.Parse(legacyTokenExpiryLayout, st.Expiry)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error parsing token expiry '%s': %v", st.Expiry, err)
+		}
+		token.Expiry = expiry
+	}
+
+	return token, nil
+}
+
+// Tokens holds credentials for each account, keyed by spotify user ID. Older
+// files had a single Spotify entry, which is moved into Accounts the first
+// time it's used and we know whose it is.
 type Tokens struct {
-	Spotify SpotifyTokens
+	Accounts map[string]*SpotifyTokens `json:"accounts"`
+	Spotify  *SpotifyTokens            `json:",omitempty"`
 }
 
-var globalTokens Tokens
+func ReadTokens(path string) (*Tokens, error) {
+	tokens := &Tokens{
+		Accounts: make(map[string]*SpotifyTokens),
+	}
 
-func ReadTokens() (tokens *Tokens) {
-	if _, err := os.Stat("tokens.json"); os.IsNotExist(err) {
-		tokens = &globalTokens
-		return
+	file, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return tokens, nil
 	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading tokens: %v", err)
+	}
+
+	err = json.Unmarshal(file, tokens)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling tokens: %v", err)
+	}
+
+	if tokens.Accounts == nil {
+		tokens.Accounts = make(map[string]*SpotifyTokens)
+	}
+
+	if tokens.Spotify != nil && tokens.Spotify.AccessToken == "" {
+		tokens.Spotify = nil
+	}
+
+	return tokens, nil
+}
 
-	file, e := ioutil.ReadFile("tokens.json")
-	if e != nil {
-		fmt.Printf("File error: %v\n", e)
-		os.Exit(1)
+func WriteTokens(path string, tokens *Tokens) error {
+	json, err := json.Marshal(tokens)
+	if err != nil {
+		return fmt.Errorf("error saving tokens: %v", err)
 	}
 
-	json.Unmarshal(file, &globalTokens)
+	err = WriteFileAtomic(path, json, 0600)
+	if err != nil {
+		return fmt.Errorf("error saving tokens: %v", err)
+	}
 
-	tokens = &globalTokens
-	return
+	return nil
 }
 
-func WriteTokens(tokens *Tokens) {
-	var tokensJson, err = json.Marshal(tokens)
+// UpdateTokens reads, changes and writes the tokens under a lock so
+// concurrent runs don't lose each other's accounts.
+func UpdateTokens(path string, update func(*Tokens) error) error {
+	lock, err := LockFile(path + ".lock")
+	if err != nil {
+		return err
+	}
+
+	defer lock.Unlock()
+
+	tokens, err := ReadTokens(path)
 	if err != nil {
-		fmt.Printf("JSON error: %v\n", err)
+		return err
+	}
 
+	err = update(tokens)
+	if err != nil {
+		return err
 	}
 
-	err = ioutil.WriteFile("tokens.json", tokensJson, 0644)
+	return WriteTokens(path, tokens)
+}
+
+// Add stores token under user. When it was refreshed from the old single
+// account entry, logged in with the same refresh token, that entry is dropped
+// now we know whose it is.
+func (t *Tokens) Add(user string, token *oauth2.Token, original *oauth2.Token) {
+	t.Accounts[user] = NewSpotifyTokens(token)
+	if t.Spotify != nil && t.Spotify.RefreshToken == original.RefreshToken {
+		t.Spotify = nil
+	}
+}
+
+func (t *Tokens) Users() []string {
+	users := make([]string, 0, len(t.Accounts))
+	for user := range t.Accounts {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	return users
+}
+
+type ReauthorizationError struct {
+	User string
+	Err  error
+}
+
+func (e *ReauthorizationError) Error() string {
+	if e.User == "" {
+		return fmt.Sprintf("re-authorization required, run 'accounts add': %v", e.Err)
+	}
+	return fmt.Sprintf("re-authorization required for %s, run 'accounts add': %v", e.User, e.Err)
+}
+
+// Spotify answers invalid_grant once a refresh token has been revoked, after
+// which nothing but logging in again helps.
+func revoked(err error) bool {
+	re, ok := err.(*oauth2.RetrieveError)
+	return ok && re.Response != nil && re.Response.StatusCode == http.StatusBadRequest && bytes.Contains(re.Body, []byte("invalid_grant"))
+}
+
+// PersistentTokenSource writes tokens back to the store whenever the
+// underlying source refreshes them, so the next run starts with a valid
+// access token and, if spotify rotated it, the new refresh token.
+type PersistentTokenSource struct {
+	Source oauth2.TokenSource
+	Path   string
+	User   string
+	lock   sync.Mutex
+	saved  string
+}
+
+func NewPersistentTokenSource(source oauth2.TokenSource, path, user string, token *oauth2.Token) *PersistentTokenSource {
+	return &PersistentTokenSource{
+		Source: source,
+		Path:   path,
+		User:   user,
+		saved:  token.AccessToken,
+	}
+}
+
+func (s *PersistentTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.Source.Token()
 	if err != nil {
-		fmt.Printf("File error: %v\n", err)
-		os.Exit(1)
+		if revoked(err) {
+			return nil, &ReauthorizationError{User: s.User, Err: err}
+		}
+		return nil, err
 	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if token.AccessToken != s.saved {
+		err := UpdateTokens(s.Path, func(tokens *Tokens) error {
+			tokens.Accounts[s.User] = NewSpotifyTokens(token)
+			return nil
+		})
+		if err != nil {
+			log.Printf("warning: unable to save refreshed token for %s: %v", s.User, err)
+		} else {
+			s.saved = token.AccessToken
+		}
+	}
+
+	return token, nil
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestSpotifyTokensExpiry(t *testing.T) {
+	expiry := time.Date(2019, 6, 1, 10, 0, 0, 0, time.FixedZone("PDT", -7*60*60))
+
+	tests := []struct {
+		name     string
+		expiry   string
+		expected time.Time
+		fails    bool
+	}{
+		{"rfc3339", expiry.Format(time.RFC3339), expiry, false},
+		{"legacy", expiry.Format(legacyTokenExpiryLayout), expiry, false},
+		{"none", "", time.Time{}, false},
+		{"invalid", "next tuesday", time.Time{}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token, err := (&SpotifyTokens{AccessToken: "access", Expiry: test.expiry}).Token()
+			if test.fails {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !token.Expiry.Equal(test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, token.Expiry)
+			}
+		})
+	}
+
+	saved, err := NewSpotifyTokens(&oauth2.Token{AccessToken: "access", Expiry: expiry}).Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !saved.Expiry.Equal(expiry) {
+		t.Errorf("expected %v to round trip, got %v", expiry, saved.Expiry)
+	}
+}
+
+func TestPersistentTokenSource(t *testing.T) {
+	tests := []struct {
+		name    string
+		refresh string
+		expiry  time.Time
+		saved   bool
+		revoked bool
+	}{
+		{"valid", "mock-refresh", time.Now().Add(time.Hour), false, false},
+		{"refreshed", "mock-refresh", time.Now().Add(-time.Hour), true, false},
+		{"revoked", "revoked", time.Now().Add(-time.Hour), false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testTempDir(t)
+			defer os.RemoveAll(dir)
+
+			m := NewMockSpotifyServer(NewFakeMusicService(testFixture()))
+			defer m.Close()
+
+			path := filepath.Join(dir, "tokens.json")
+			old := &oauth2.Token{AccessToken: "old", RefreshToken: test.refresh, TokenType: "Bearer", Expiry: test.expiry}
+			source := NewPersistentTokenSource(m.OAuthConfig("").TokenSource(context.Background(), old), path, "tester", old)
+
+			token, err := source.Token()
+			if test.revoked {
+				if _, ok := err.(*ReauthorizationError); !ok {
+					t.Fatalf("expected a reauthorization error, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			tokens, err := ReadTokens(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			account, saved := tokens.Accounts["tester"]
+			if saved != test.saved {
+				t.Fatalf("expected saved %v, got %v", test.saved, saved)
+			}
+			if saved && (account.AccessToken != token.AccessToken || account.AccessToken == "old") {
+				t.Errorf("expected the refreshed token to be saved, got %+v", account)
+			}
+		})
+	}
+}
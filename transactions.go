@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/zmb3/spotify"
+)
+
+const PlaylistBatchSize = 50
+
+type PlaylistTransaction struct {
+	PlaylistID spotify.ID     `json:"playlistId"`
+	Started    time.Time      `json:"started"`
+	Before     []spotify.ID   `json:"before"`
+	After      []spotify.ID   `json:"after"`
+	Removing   []spotify.ID   `json:"removing"`
+	Adding     []spotify.ID   `json:"adding"`
+	Moves      []PlaylistMove `json:"moves"`
+	Removed    int            `json:"removed"`
+	Added      int            `json:"added"`
+	Moved      int            `json:"moved"`
+	path       string
+}
+
+func NewPlaylistTransaction(path string, id spotify.ID, before []spotify.ID, pu *PlaylistUpdate) *PlaylistTransaction {
+	return &PlaylistTransaction{
+		path:       path,
+		PlaylistID: id,
+		Started:    time.Now(),
+		Before:     append([]spotify.ID{}, before...),
+		After:      pu.GetIdsAfter().ToArray(),
+		Removing:   pu.GetIdsToRemove().ToArray(),
+		Adding:     pu.GetIdsToAdd().ToArray(),
+		Moves:      pu.GetMoves(),
+	}
+}
+
+func LoadPlaylistTransaction(path string) (tx *PlaylistTransaction, err error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading transaction: %v", err)
+	}
+
+	tx = &PlaylistTransaction{path: path}
+	err = json.Unmarshal(file, tx)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling transaction: %v", err)
+	}
+
+	return
+}
+
+func (tx *PlaylistTransaction) save() error {
+	json, err := json.Marshal(tx)
+	if err != nil {
+		return fmt.Errorf("error saving transaction: %v", err)
+	}
+
+	err = WriteFileAtomic(tx.path, json, 0644)
+	if err != nil {
+		return fmt.Errorf("error saving transaction: %v", err)
+	}
+
+	return nil
+}
+
+func (tx *PlaylistTransaction) finish() error {
+	err := os.Remove(tx.path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing transaction: %v", err)
+	}
+	return nil
+}
+
+func (tx *PlaylistTransaction) apply(spotifyClient MusicService) error {
+	for tx.Removed < len(tx.Removing) {
+		batch := tx.Removing[tx.Removed:min(tx.Removed+PlaylistBatchSize, len(tx.Removing))]
+		_, err := spotifyClient.RemoveTracksFromPlaylist(tx.PlaylistID, batch...)
+		if err != nil {
+			return fmt.Errorf("error removing tracks: %v", err)
+		}
+
+		tx.Removed += len(batch)
+		if err := tx.save(); err != nil {
+			return err
+		}
+
+		log.Printf("removed %v in batch from %s (%d/%d)", len(batch), tx.PlaylistID, tx.Removed, len(tx.Removing))
+	}
+
+	for tx.Added < len(tx.Adding) {
+		batch := tx.Adding[tx.Added:min(tx.Added+PlaylistBatchSize, len(tx.Adding))]
+		_, err := spotifyClient.AddTracksToPlaylist(tx.PlaylistID, batch...)
+		if err != nil {
+			return fmt.Errorf("error adding tracks: %v", err)
+		}
+
+		tx.Added += len(batch)
+		if err := tx.save(); err != nil {
+			return err
+		}
+
+		log.Printf("added %v in batch to %s (%d/%d)", len(batch), tx.PlaylistID, tx.Added, len(tx.Adding))
+	}
+
+	for tx.Moved < len(tx.Moves) {
+		move := tx.Moves[tx.Moved]
+		_, err := spotifyClient.ReorderPlaylistTracks(tx.PlaylistID, spotify.PlaylistReorderOptions{
+			RangeStart:   move.From,
+			RangeLength:  1,
+			InsertBefore: move.To,
+		})
+		if err != nil {
+			return fmt.Errorf("error reordering tracks: %v", err)
+		}
+
+		tx.Moved += 1
+		if err := tx.save(); err != nil {
+			return err
+		}
+	}
+
+	if len(tx.Moves) > 0 {
+		log.Printf("reordered %v in %s", len(tx.Moves), tx.PlaylistID)
+	}
+
+	return nil
+}
+
+func localTracks(ids []spotify.ID) int {
+	n := 0
+	for _, id := range ids {
+		if len(id) == 0 {
+			n += 1
+		}
+	}
+	return n
+}
+
+func sameTracks(a, b []spotify.ID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Rollback restores the playlist to how it was before, whatever the journal
+// says was written, because a failed request may still have been applied. It
+// applies the difference between the live playlist and the old one, rather
+// than replacing it, so local tracks, which can't be added back, stay where
+// they are. The journal is kept until that's done so an interrupted rollback
+// is tried again.
+func (tx *PlaylistTransaction) Rollback(spotifyClient MusicService) error {
+	tracks, err := GetPlaylistTracks(spotifyClient, tx.PlaylistID)
+	if err != nil {
+		return fmt.Errorf("error rolling back %s: %v", tx.PlaylistID, err)
+	}
+
+	live := GetTrackIdsFromPlaylistTracks(tracks)
+	if sameTracks(live, tx.Before) {
+		log.Printf("%s is unchanged, nothing to roll back", tx.PlaylistID)
+		return tx.finish()
+	}
+
+	if missing := localTracks(tx.Before) - localTracks(live); missing > 0 {
+		log.Printf("warning: %d local tracks are missing from %s and can't be restored", missing, tx.PlaylistID)
+	}
+
+	update := NewPlaylistUpdate(live)
+	for _, id := range tx.Before {
+		update.AddTrack(id)
+	}
+
+	rollback := NewPlaylistTransaction(tx.path, tx.PlaylistID, tx.Before, update)
+
+	log.Printf("rolling back %s to %d tracks (removing %d, adding %d, moving %d)", tx.PlaylistID, len(tx.Before),
+		len(rollback.Removing), len(rollback.Adding), len(rollback.Moves))
+
+	if err := rollback.save(); err != nil {
+		return err
+	}
+
+	err = rollback.apply(spotifyClient)
+	if err != nil {
+		return fmt.Errorf("error rolling back %s: %v", tx.PlaylistID, err)
+	}
+
+	return tx.finish()
+}
+
+func (tx *PlaylistTransaction) Commit(spotifyClient MusicService) error {
+	if err := tx.save(); err != nil {
+		return err
+	}
+
+	err := tx.apply(spotifyClient)
+	if err != nil {
+		log.Printf("update failed: %v", err)
+
+		rollbackErr := tx.Rollback(spotifyClient)
+		if rollbackErr != nil {
+			log.Printf("%v, will retry on the next run", rollbackErr)
+		}
+
+		return err
+	}
+
+	return tx.finish()
+}
+
+func RecoverPlaylistTransaction(spotifyClient MusicService, path string, id spotify.ID) (bool, error) {
+	tx, err := LoadPlaylistTransaction(path)
+	if err != nil {
+		return false, err
+	}
+
+	if tx == nil {
+		return false, nil
+	}
+
+	log.Printf("found unfinished update of %s from %v (removed %d/%d, added %d/%d, moved %d/%d)", id, tx.Started,
+		tx.Removed, len(tx.Removing), tx.Added, len(tx.Adding), tx.Moved, len(tx.Moves))
+
+	return true, tx.Rollback(spotifyClient)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zmb3/spotify"
+)
+
+// lossyMusicService applies additions but reports them as failed, like a
+// request whose response never arrived.
+type lossyMusicService struct {
+	*FakeMusicService
+}
+
+func (l *lossyMusicService) AddTracksToPlaylist(playlistID spotify.ID, trackIDs ...spotify.ID) (string, error) {
+	l.FakeMusicService.AddTracksToPlaylist(playlistID, trackIDs...)
+	return "", fmt.Errorf("connection reset")
+}
+
+func countCalls(f *FakeMusicService, prefix string) int {
+	n := 0
+	for _, call := range f.Calls {
+		if strings.HasPrefix(call, prefix) {
+			n += 1
+		}
+	}
+	return n
+}
+
+// describe names local tracks, which have no ID, so they show up in
+// expectations.
+func describe(ids []string) string {
+	names := make([]string, 0)
+	for _, id := range ids {
+		if id == "" {
+			id = "local"
+		}
+		names = append(names, id)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestPlaylistTransactionRollback(t *testing.T) {
+	local := testTrack("", "local", "local", testEpoch)
+
+	tests := []struct {
+		name     string
+		before   []spotify.PlaylistTrack
+		live     []spotify.PlaylistTrack
+		calls    int
+		expected string
+	}{
+		{"unchanged", testTracks("t", 3, testEpoch), testTracks("t", 3, testEpoch), 0, "t0 t1 t2"},
+		{"changed", testTracks("t", 3, testEpoch), testTracks("u", 2, testEpoch), 2, "t0 t1 t2"},
+		{"reordered", testTracks("t", 2, testEpoch), []spotify.PlaylistTrack{testTrack("t1", "a", "b", testEpoch), testTrack("t0", "a", "b", testEpoch)}, 1, "t0 t1"},
+		{"local tracks kept", append(testTracks("t", 2, testEpoch), local), append(testTracks("u", 2, testEpoch), local), 4, "t0 t1 local"},
+		{"local tracks moved back", append([]spotify.PlaylistTrack{local}, testTracks("t", 2, testEpoch)...), append(testTracks("u", 2, testEpoch), local), 2, "local t0 t1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := testTempDir(t)
+			defer os.RemoveAll(dir)
+
+			f := NewFakeMusicService(testFixture(testPlaylist("pl", "Playlist", test.live)))
+
+			// Nothing is marked as written, so only the live playlist shows
+			// whether anything was applied.
+			path := filepath.Join(dir, "tx.json")
+			tx := NewPlaylistTransaction(path, "pl", GetTrackIdsFromPlaylistTracks(test.before), NewPlaylistUpdate(nil))
+			if err := tx.save(); err != nil {
+				t.Fatal(err)
+			}
+
+			recovered, err := RecoverPlaylistTransaction(f, path, "pl")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !recovered {
+				t.Fatalf("expected to recover")
+			}
+
+			if replaced := countCalls(f, "ReplacePlaylistTracks"); replaced != 0 {
+				t.Errorf("expected no replaces, got %d", replaced)
+			}
+			if calls := len(mutatingCalls(f)); calls != test.calls {
+				t.Errorf("expected %d calls, got %d: %v", test.calls, calls, mutatingCalls(f))
+			}
+			if actual := describe(playlistIds(f, "pl")); actual != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, actual)
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("expected the journal to be removed: %v", err)
+			}
+		})
+	}
+}
+
+func TestPlaylistTransactionRollbackInterrupted(t *testing.T) {
+	dir := testTempDir(t)
+	defer os.RemoveAll(dir)
+
+	local := testTrack("", "local", "local", testEpoch)
+	f := NewFakeMusicService(testFixture(testPlaylist("pl", "Playlist", append(testTracks("u", 2, testEpoch), local))))
+
+	path := filepath.Join(dir, "tx.json")
+	tx := NewPlaylistTransaction(path, "pl", splitIds("t0 t1"), NewPlaylistUpdate(nil))
+	tx.Before = append(tx.Before, "")
+	if err := tx.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := RecoverPlaylistTransaction(&lossyMusicService{f}, path, "pl"); err == nil {
+		t.Fatalf("expected the rollback to fail")
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected the journal to be kept: %v", err)
+	}
+
+	recovered, err := RecoverPlaylistTransaction(f, path, "pl")
+	if err != nil || !recovered {
+		t.Fatalf("expected to recover: %v", err)
+	}
+
+	if actual := describe(playlistIds(f, "pl")); actual != "t0 t1 local" {
+		t.Errorf("expected to be rolled back, got %q", actual)
+	}
+}
+
+func TestPlaylistTransactionLostResponse(t *testing.T) {
+	dir := testTempDir(t)
+	defer os.RemoveAll(dir)
+
+	f := NewFakeMusicService(testFixture(testPlaylist("pl", "Playlist", testTracks("t", 3, testEpoch))))
+
+	update := NewPlaylistUpdate(splitIds("t0 t1 t2"))
+	for _, id := range splitIds("t0 t1 t2 n0") {
+		update.AddTrack(id)
+	}
+
+	// The very first request fails, so the journal shows nothing written even
+	// though the tracks were added.
+	path := filepath.Join(dir, "tx.json")
+	tx := NewPlaylistTransaction(path, "pl", splitIds("t0 t1 t2"), update)
+	if err := tx.Commit(&lossyMusicService{f}); err == nil {
+		t.Fatalf("expected the commit to fail")
+	}
+
+	if actual := strings.Join(playlistIds(f, "pl"), " "); actual != "t0 t1 t2" {
+		t.Errorf("expected to be rolled back, got %q", actual)
+	}
+
+	if recovered, err := RecoverPlaylistTransaction(f, path, "pl"); err != nil || recovered {
+		t.Errorf("expected nothing to recover: %v", err)
+	}
+}